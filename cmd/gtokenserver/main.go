@@ -23,9 +23,16 @@ THE SOFTWARE.
 */
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/ikedam/gtokenserver/constants"
 	"github.com/ikedam/gtokenserver/log"
 	"github.com/ikedam/gtokenserver/server"
@@ -46,6 +53,11 @@ func main() {
 		"Address to bind: specify 0.0.0.0 to accept remote connections especially inside docker.",
 	)
 	pflag.IntP("port", "p", 8080, "Port to bind")
+	pflag.StringSlice(
+		"listen",
+		nil,
+		"URLs to listen like tcp://127.0.0.1:8080 or unix:///run/gtokenserver.sock: host and port are ignored if specified",
+	)
 	pflag.StringSliceP(
 		"scopes",
 		"s",
@@ -57,9 +69,21 @@ func main() {
 	)
 	pflag.String("project", "", "Google Project ID")
 	pflag.String("config", "", "Configuration file")
+	pflag.Bool("watch-config", true, "Reload the configuration file when it's changed")
 	pflag.String("cloudsdk-config", "", "Directory storing configurations for cloud-sdk (gcloud command)")
 	pflag.String("google-application-credentials", "", "File storing JSON key for the service account")
+	pflag.String("impersonate-service-account", "", "Email of the service account to impersonate")
+	pflag.StringSlice(
+		"impersonate-delegates",
+		nil,
+		"Emails of service accounts in the delegation chain to impersonate the service account",
+	)
 	pflag.String("log-level", "Info", "Log level: Trace, Debug, Info, Warning, Error")
+	pflag.String("log-format", log.FormatText, "Log format: text, json, logfmt")
+	pflag.String("log-output", log.OutputStderr, "Log output: stderr, stdout, syslog, journald or a path to a file")
+	pflag.Int("log-max-size", 100, "Size in megabytes to rotate the log file: 0 not to rotate")
+	pflag.Int("log-max-backups", 3, "Number of rotated log files to keep")
+	pflag.Duration("shutdown-timeout", 10*time.Second, "Maximum duration to wait for active requests on shutdown")
 	pflag.BoolP("version", "v", false, "Show version and exit")
 
 	pflag.Parse()
@@ -72,41 +96,173 @@ func main() {
 		fmt.Printf("gtokenserver %v:%v\n", version, commit)
 		os.Exit(0)
 	}
-	logLevel := viper.GetString("log-level")
-	if err := log.SetLevelByName(logLevel); err != nil {
-		log.WithError(err).Errorf("Failed to configure log-level")
+	if err := configureLog(); err != nil {
+		log.WithError(err).Errorf("Failed to configure logs")
+		os.Exit(constants.ExitCodeInvalidConfiguration)
+	}
+	config, err := readConfig(false)
+	if err != nil {
+		log.WithError(err).Errorf("Failed to parse configurations")
 		os.Exit(constants.ExitCodeInvalidConfiguration)
 	}
+	s, err := server.NewServer(config)
+	if err != nil {
+		log.WithError(err).Errorf("Invalid configuration")
+		os.Exit(constants.ExitCodeInvalidConfiguration)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go handleSignals(s, cancel)
+	if viper.GetString("config") != "" && viper.GetBool("watch-config") {
+		if err := watchConfig(ctx, s, viper.GetString("config")); err != nil {
+			log.WithError(err).Errorf("Failed to watch the configuration file")
+			os.Exit(constants.ExitCodeInvalidConfiguration)
+		}
+	}
+	if err := s.Serve(ctx); err != nil {
+		log.WithError(err).Errorf("Failed to launch server")
+		os.Exit(constants.ExitCodeInvalidConfiguration)
+	}
+	os.Exit(0)
+}
+
+// configReloadDelay is the delay to reload the configuration file after changes.
+const configReloadDelay = 500 * time.Millisecond
+
+// watchConfig reloads the configuration file when it's changed until ctx is done.
+// The directory is watched to detect files replaced by editors
+// and symbolic links switched like ConfigMaps of Kubernetes.
+// Reloads are serialized with reloadMutex, as viper is not safe for concurrent use.
+func watchConfig(ctx context.Context, s *server.Server, configFile string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create a watcher: %w", err)
+	}
+	file := filepath.Clean(configFile)
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("failed to watch %v: %w", filepath.Dir(file), err)
+	}
+	realFile, _ := filepath.EvalSymlinks(file)
+	go func() {
+		defer watcher.Close()
+		var reloadTimer *time.Timer
+		for {
+			select {
+			case <-ctx.Done():
+				if reloadTimer != nil {
+					reloadTimer.Stop()
+				}
+				return
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.WithError(err).
+					WithField("config", file).
+					Warning("Error in watching the configuration file")
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				currentFile, _ := filepath.EvalSymlinks(file)
+				changed := filepath.Clean(event.Name) == file &&
+					event.Op&(fsnotify.Write|fsnotify.Create) != 0
+				if !changed && (currentFile == "" || currentFile == realFile) {
+					continue
+				}
+				realFile = currentFile
+				// Wait for the file to be written completely as editors may write it in multiple steps.
+				if reloadTimer != nil {
+					reloadTimer.Stop()
+				}
+				reloadTimer = time.AfterFunc(configReloadDelay, func() {
+					log.WithField("config", file).Info("Configuration file is changed")
+					reloadConfig(s)
+				})
+			}
+		}
+	}()
+	return nil
+}
+
+// readConfig reads the configuration file if specified.
+// Failures to read the file are ignored unless strict.
+func readConfig(strict bool) (*server.Config, error) {
 	configfile := viper.GetString("config")
 	if configfile != "" {
 		viper.SetConfigFile(configfile)
 		if err := viper.ReadInConfig(); err != nil {
+			if strict {
+				return nil, fmt.Errorf("failed to read %v: %w", configfile, err)
+			}
 			log.WithError(err).
 				WithField("config", configfile).
 				Errorf("Failed to read configuration file: ignored")
 		} else {
-			log.WithField("config", viper.ConfigFileUsed).
+			log.WithField("config", viper.ConfigFileUsed()).
 				Debug("Using config file")
 		}
-		if logLevel != viper.GetString("log-level") {
-			logLevel = viper.GetString("log-level")
-			if err := log.SetLevelByName(logLevel); err != nil {
-				log.WithError(err).Errorf("Failed to configure log-level")
-				os.Exit(constants.ExitCodeInvalidConfiguration)
-			}
+		if err := configureLog(); err != nil {
+			return nil, fmt.Errorf("failed to configure logs: %w", err)
 		}
 	}
 
 	var config server.Config
 	if err := viper.Unmarshal(&config); err != nil {
-		log.WithError(err).Errorf("Failed to parse configurations")
-		os.Exit(constants.ExitCodeInvalidConfiguration)
+		return nil, err
 	}
-	log.WithField("config", config).Debugf("Configuration read")
-	s := server.NewServer(&config)
-	if err := s.Serve(); err != nil {
-		log.WithError(err).Errorf("Failed to launch server")
-		os.Exit(constants.ExitCodeInvalidConfiguration)
+	log.WithField("config", config.String()).Debugf("Configuration read")
+	return &config, nil
+}
+
+// configureLog applies log-* options.
+func configureLog() error {
+	if err := log.SetLevelByName(viper.GetString("log-level")); err != nil {
+		return err
+	}
+	if err := log.SetFormatByName(viper.GetString("log-format")); err != nil {
+		return err
+	}
+	return log.SetOutput(log.OutputConfig{
+		Output:     viper.GetString("log-output"),
+		MaxSize:    viper.GetInt("log-max-size"),
+		MaxBackups: viper.GetInt("log-max-backups"),
+	})
+}
+
+// handleSignals stops the server with SIGTERM or SIGINT,
+// and reloads the configuration with SIGHUP.
+func handleSignals(s *server.Server, stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			log.WithField("signal", sig).Info("Stopping...")
+			signal.Stop(signals)
+			stop()
+			return
+		}
+		log.Info("Reloading configuration...")
+		reloadConfig(s)
+	}
+}
+
+// reloadMutex serializes reloads as viper is not safe for concurrent use.
+var reloadMutex sync.Mutex
+
+// reloadConfig reads the configuration file and applies it to the server.
+// Invalid configurations are ignored.
+func reloadConfig(s *server.Server) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	config, err := readConfig(true)
+	if err != nil {
+		log.WithError(err).Error("Failed to reload configuration: ignored")
+		return
+	}
+	if err := s.Reload(config); err != nil {
+		log.WithError(err).Error("Invalid configuration: ignored")
 	}
-	os.Exit(0)
 }
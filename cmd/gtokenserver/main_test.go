@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ikedam/gtokenserver/log"
+	"github.com/spf13/viper"
+)
+
+func TestReadConfigLogsNoSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gtokenserver")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "gtokenserver.yaml")
+	const (
+		adminToken = "admin-secret-token"
+		keyFile    = "/secrets/fake-key.pem"
+		credFile   = "/secrets/service-account.json"
+	)
+	if err := ioutil.WriteFile(configFile, []byte(strings.Join([]string{
+		"log-level: debug",
+		"log-format: json",
+		"google-application-credentials: " + credFile,
+		"admin:",
+		"  port: 8081",
+		"  token: " + adminToken,
+		"fake:",
+		"  key-file: " + keyFile,
+		"service-accounts:",
+		"  - alias: deployer",
+		"    google-application-credentials: " + credFile,
+	}, "\n")), 0600); err != nil {
+		t.Fatalf("failed to write the configuration file: %v", err)
+	}
+
+	var buf bytes.Buffer
+	out := log.Logger.Out
+	level := log.Logger.GetLevel()
+	formatter := log.Logger.Formatter
+	defer func() {
+		viper.Reset()
+		log.Logger.Out = out
+		log.Logger.SetLevel(level)
+		log.Logger.Formatter = formatter
+	}()
+	viper.Set("config", configFile)
+	viper.Set("log-output", "")
+
+	if _, err := readConfig(true); err != nil {
+		t.Fatalf("failed to read the configuration: %v", err)
+	}
+	// The first read configures the log output, which is kept in following reads.
+	log.Logger.Out = &buf
+	if _, err := readConfig(true); err != nil {
+		t.Fatalf("failed to read the configuration: %v", err)
+	}
+
+	output := buf.String()
+	if !strings.Contains(output, "Configuration read") {
+		t.Fatalf("configuration is not logged: %v", output)
+	}
+	for _, secret := range []string{adminToken, keyFile, credFile} {
+		if strings.Contains(output, secret) {
+			t.Errorf("%q is logged: %v", secret, output)
+		}
+	}
+}
@@ -1,11 +1,11 @@
 package util
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 
 	"github.com/ikedam/gtokenserver/log"
 
@@ -13,29 +13,58 @@ import (
 )
 
 type credentialsJSON struct {
-	ClientID    string `json:"client_id,omitempty"`
-	Type        string `json:"type,omitempty"`
-	ClientEmail string `json:"client_email,omitempty"`
+	ClientID     string `json:"client_id,omitempty"`
+	Type         string `json:"type,omitempty"`
+	ClientEmail  string `json:"client_email,omitempty"`
+	ClientSecret string `json:"client_secret,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	PrivateKey   string `json:"private_key,omitempty"`
+	PrivateKeyID string `json:"private_key_id,omitempty"`
+	TokenURI     string `json:"token_uri,omitempty"`
+	// Issuer is the issuer of ID tokens of fake credentials
+	Issuer string `json:"issuer,omitempty"`
 }
 
 const (
 	typeAuthorizedUser = "authorized_user"
 	typeServiceAccount = "service_account"
-
-	userInfoEndpoint = "https://www.googleapis.com/oauth2/v1/userinfo"
 )
 
+// userInfoEndpoint is replaced in tests
+var userInfoEndpoint = "https://www.googleapis.com/oauth2/v1/userinfo"
+
 // GetIDOfCredentials returns ID of the credentials
 func GetIDOfCredentials(cred *google.Credentials) (string, error) {
 	var c credentialsJSON
 	if err := json.Unmarshal(cred.JSON, &c); err != nil {
 		return "", fmt.Errorf("Failed to parse credentials JSON: %w", err)
 	}
+	if c.Type == typeImpersonatedServiceAccount {
+		return getIDOfImpersonatedCredentials(cred)
+	}
 	return c.ClientID, nil
 }
 
-// GetEmailOfCredentials returns Email of the credentials
-func GetEmailOfCredentials(cred *google.Credentials) (string, error) {
+func getIDOfImpersonatedCredentials(cred *google.Credentials) (string, error) {
+	var c impersonatedCredentialsJSON
+	if err := json.Unmarshal(cred.JSON, &c); err != nil {
+		return "", fmt.Errorf("Failed to parse credentials JSON: %w", err)
+	}
+	email, err := c.email()
+	if err != nil {
+		return "", err
+	}
+	var source credentialsJSON
+	if err := json.Unmarshal(c.SourceCredentials, &source); err != nil {
+		return "", fmt.Errorf("Failed to parse source credentials JSON: %w", err)
+	}
+	// The same source credentials can impersonate different service accounts.
+	return fmt.Sprintf("%v:%v", source.ClientID, email), nil
+}
+
+// GetEmailOfCredentials returns Email of the credentials.
+// Requests to resolve emails are traced as children of the span in ctx.
+func GetEmailOfCredentials(ctx context.Context, cred *google.Credentials) (string, error) {
 	var c credentialsJSON
 	if err := json.Unmarshal(cred.JSON, &c); err != nil {
 		return "", fmt.Errorf("Failed to parse credentials JSON: %w", err)
@@ -43,9 +72,15 @@ func GetEmailOfCredentials(cred *google.Credentials) (string, error) {
 
 	switch c.Type {
 	case typeAuthorizedUser:
-		return getEmailOfAuthorizedUser(cred)
-	case typeServiceAccount:
+		return getEmailOfAuthorizedUser(ctx, cred)
+	case typeServiceAccount, typeFakeServiceAccount:
 		return c.ClientEmail, nil
+	case typeImpersonatedServiceAccount:
+		var impersonated impersonatedCredentialsJSON
+		if err := json.Unmarshal(cred.JSON, &impersonated); err != nil {
+			return "", fmt.Errorf("Failed to parse credentials JSON: %w", err)
+		}
+		return impersonated.email()
 	}
 
 	return "", fmt.Errorf("Unexpected type: %v", c.Type)
@@ -55,7 +90,7 @@ type userInfoResponse struct {
 	Email string
 }
 
-func getEmailOfAuthorizedUser(cred *google.Credentials) (string, error) {
+func getEmailOfAuthorizedUser(ctx context.Context, cred *google.Credentials) (string, error) {
 	// "authorized_user" credentials don't store email address.
 	// Then query it to the userinfo endpoint.
 	// This doesn't work for "service_account" credentials.
@@ -63,15 +98,13 @@ func getEmailOfAuthorizedUser(cred *google.Credentials) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("Failed to get token to resolve email: %w", err)
 	}
-	userInfoURL, err := url.Parse(userInfoEndpoint)
+	req, err := http.NewRequestWithContext(HTTPContext(ctx), http.MethodGet, userInfoEndpoint, nil)
 	if err != nil {
 		return "", fmt.Errorf("Failed to resolve the userinfo endpoint: %w", err)
 	}
-	q := userInfoURL.Query()
-	q.Add("access_token", token.AccessToken)
-	userInfoURL.RawQuery = q.Encode()
-	c := http.Client{}
-	rsp, err := c.Get(userInfoURL.String())
+	// Not in the query not to record the token in traces and logs.
+	token.SetAuthHeader(req)
+	rsp, err := httpClient.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("Failed to access the userinfo endpoint: %w", err)
 	}
@@ -83,13 +116,13 @@ func getEmailOfAuthorizedUser(cred *google.Credentials) (string, error) {
 	if rsp.StatusCode != http.StatusOK {
 		log.WithField("status", rsp.StatusCode).
 			WithField("body", string(body)).
-			Debugf("Unexpected response from userinfo endpoint")
+			Debug("Unexpected response from userinfo endpoint")
 		return "", fmt.Errorf("Unexpected response from the userinfo endpoint: %v", rsp.StatusCode)
 	}
 	var userInfo userInfoResponse
 	if err := json.Unmarshal(body, &userInfo); err != nil {
 		log.WithField("body", string(body)).
-			Debugf("Unexpected response from userinfo endpoint")
+			Debug("Unexpected response from userinfo endpoint")
 		return "", fmt.Errorf("Failed to parse response from the userinfo endpoint: %err", err)
 	}
 	return userInfo.Email, nil
@@ -0,0 +1,88 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// testTracerProvider is installed in every test recording spans,
+// as tracers obtained before the first provider is installed keep delegating to it.
+var testTracerProvider = sdktrace.NewTracerProvider()
+
+// recordSpans installs testTracerProvider until the test finishes,
+// and returns the exporter of spans in the test.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	processor := sdktrace.NewSimpleSpanProcessor(exporter)
+	previousProvider := otel.GetTracerProvider()
+	t.Cleanup(func() {
+		testTracerProvider.UnregisterSpanProcessor(processor)
+		otel.SetTracerProvider(previousProvider)
+	})
+	testTracerProvider.RegisterSpanProcessor(processor)
+	otel.SetTracerProvider(testTracerProvider)
+	return exporter
+}
+
+func TestGetEmailOfAuthorizedUserDoesNotTraceToken(t *testing.T) {
+	exporter := recordSpans(t)
+
+	const accessToken = "ya29.opaque-secret-access-token"
+	userInfo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery != "" {
+			t.Errorf("unexpected query: %v", r.URL.RawQuery)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer "+accessToken {
+			t.Errorf("unexpected Authorization header: %v", auth)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"email":"user@example.com"}`)
+	}))
+	defer userInfo.Close()
+	originalEndpoint := userInfoEndpoint
+	userInfoEndpoint = userInfo.URL + "/oauth2/v1/userinfo"
+	defer func() {
+		userInfoEndpoint = originalEndpoint
+	}()
+
+	cred := &google.Credentials{
+		JSON:        []byte(`{"type":"authorized_user"}`),
+		TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: accessToken}),
+	}
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "parent")
+	email, err := GetEmailOfCredentials(ctx, cred)
+	parent.End()
+	if err != nil {
+		t.Fatalf("failed to get the email: %v", err)
+	}
+	if email != "user@example.com" {
+		t.Errorf("unexpected email: %v", email)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) < 2 {
+		t.Fatalf("requests are not traced: %v spans", len(spans))
+	}
+	for _, span := range spans {
+		if span.SpanContext.TraceID() != parent.SpanContext().TraceID() {
+			t.Errorf("%v is not traced in the trace of the caller", span.Name)
+		}
+		for _, attr := range span.Attributes {
+			if strings.Contains(attr.Value.Emit(), accessToken) {
+				t.Errorf("the token is recorded in %v of %v", attr.Key, span.Name)
+			}
+		}
+	}
+}
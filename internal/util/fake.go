@@ -0,0 +1,153 @@
+package util
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash/fnv"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jws"
+)
+
+const (
+	typeFakeServiceAccount = "fake_service_account"
+
+	fakeTokenLifetime = time.Hour
+)
+
+// NewFakeCredentials returns credentials issuing tokens locally without accessing Google.
+// Access tokens are deterministic for the email and scopes.
+// ID tokens are signed with the key, and issued by issuer.
+func NewFakeCredentials(email, projectID, issuer string, key *rsa.PrivateKey, scopes ...string) (*google.Credentials, error) {
+	jsonBody, err := json.Marshal(&credentialsJSON{
+		Type:         typeFakeServiceAccount,
+		Issuer:       issuer,
+		ClientEmail:  email,
+		ClientID:     FakeUniqueID(email),
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		PrivateKeyID: PublicKeyID(&key.PublicKey),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to build credentials JSON: %w", err)
+	}
+	return &google.Credentials{
+		ProjectID: projectID,
+		TokenSource: oauth2.ReuseTokenSource(nil, &fakeTokenSource{
+			email:  email,
+			scopes: scopes,
+		}),
+		JSON: jsonBody,
+	}, nil
+}
+
+// FakeUniqueID returns a unique ID of a service account looking like ones of Google.
+func FakeUniqueID(email string) string {
+	h := fnv.New64a()
+	h.Write([]byte(email))
+	// Unique IDs of service accounts are 21 digits.
+	return fmt.Sprintf("1%020d", h.Sum64())
+}
+
+// PublicKeyID returns the key ID ("kid") for the key.
+func PublicKeyID(key *rsa.PublicKey) string {
+	sum := sha256.Sum256(x509.MarshalPKCS1PublicKey(key))
+	return hex.EncodeToString(sum[:20])
+}
+
+type fakeTokenSource struct {
+	email  string
+	scopes []string
+}
+
+// Token returns an opaque token determined by the email and the scopes.
+func (s *fakeTokenSource) Token() (*oauth2.Token, error) {
+	scopes := make([]string, len(s.scopes))
+	copy(scopes, s.scopes)
+	sort.Strings(scopes)
+	sum := sha256.Sum256([]byte(s.email + "\n" + strings.Join(scopes, " ")))
+	return &oauth2.Token{
+		AccessToken: "ya29.fake-" + hex.EncodeToString(sum[:]),
+		TokenType:   "Bearer",
+		Expiry:      time.Now().Add(fakeTokenLifetime),
+	}, nil
+}
+
+type fakeIDTokenSource struct {
+	cred         *credentialsJSON
+	key          *rsa.PrivateKey
+	audience     string
+	includeEmail bool
+}
+
+// Token signs an ID token locally.
+func (s *fakeIDTokenSource) Token() (*oauth2.Token, error) {
+	now := time.Now()
+	claims := &jws.ClaimSet{
+		Iss: s.cred.Issuer,
+		Sub: s.cred.ClientID,
+		Aud: s.audience,
+		Iat: now.Unix(),
+		Exp: now.Add(fakeTokenLifetime).Unix(),
+		PrivateClaims: map[string]interface{}{
+			"azp": s.cred.ClientID,
+		},
+	}
+	if s.includeEmail {
+		claims.PrivateClaims["email"] = s.cred.ClientEmail
+		claims.PrivateClaims["email_verified"] = true
+	}
+	header := &jws.Header{
+		Algorithm: "RS256",
+		Typ:       "JWT",
+		KeyID:     s.cred.PrivateKeyID,
+	}
+	idToken, err := jws.Encode(header, claims, s.key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to sign JWT: %w", err)
+	}
+	return newIDToken(idToken)
+}
+
+// JSONWebKey is a public key in JWK format
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JSONWebKeySet is a set of public keys in JWKS format
+type JSONWebKeySet struct {
+	Keys []*JSONWebKey `json:"keys"`
+}
+
+// NewJSONWebKeySet returns JWKS to verify ID tokens signed with the keys.
+func NewJSONWebKeySet(keys ...*rsa.PublicKey) *JSONWebKeySet {
+	jwks := &JSONWebKeySet{
+		Keys: []*JSONWebKey{},
+	}
+	for _, key := range keys {
+		jwks.Keys = append(jwks.Keys, &JSONWebKey{
+			Kty: "RSA",
+			Alg: "RS256",
+			Use: "sig",
+			Kid: PublicKeyID(key),
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	return jwks
+}
@@ -1,53 +1,93 @@
 package util
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/ikedam/gtokenserver/log"
+	"github.com/sirupsen/logrus"
 )
 
-// InstallHTTPLogger installs logger
+// RequestIDHeader is the header to pass request IDs, and responded with generated IDs.
+const RequestIDHeader = "X-Request-Id"
+
+// InstallHTTPLogger installs logger.
+// Requests carry loggers with request_id and client fields (see log.FromContext).
 func InstallHTTPLogger(handler http.Handler) *http.ServeMux {
 	logMux := http.NewServeMux()
 	logMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		rspWrapper := newResponseSniffer(w)
-		handler.ServeHTTP(rspWrapper, r)
-		log.Infof("%+v %+v %+v size=%v", r.Method, r.RequestURI, rspWrapper.Code(), rspWrapper.BodySize())
+		requestID := r.Header.Get(RequestIDHeader)
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		logger := log.WithFields(logrus.Fields{
+			log.FieldRequestID: requestID,
+			log.FieldClient:    client,
+		})
+
+		start := time.Now()
+		rspWrapper := NewResponseSniffer(w)
+		handler.ServeHTTP(rspWrapper, r.WithContext(log.NewContext(r.Context(), logger)))
+		logger.WithFields(logrus.Fields{
+			"method":   r.Method,
+			"path":     r.RequestURI,
+			"status":   rspWrapper.Code(),
+			"size":     rspWrapper.BodySize(),
+			"duration": time.Since(start).Seconds(),
+		}).Info("Request is handled")
 	})
 	return logMux
 }
 
-// responseSniffer wraps http.ResponseWriter
-type responseSniffer struct {
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ResponseSniffer wraps http.ResponseWriter
+type ResponseSniffer struct {
 	writer   http.ResponseWriter
 	code     int
 	bodySize int
 }
 
 // NewResponseSniffer creates a new ResponseSniffer
-func newResponseSniffer(writer http.ResponseWriter) *responseSniffer {
-	return &responseSniffer{
+func NewResponseSniffer(writer http.ResponseWriter) *ResponseSniffer {
+	return &ResponseSniffer{
 		writer: writer,
 	}
 }
 
-// Code returns status code
-func (s *responseSniffer) Code() int {
+// Code returns status code.
+// It returns 200 if nothing is written as net/http responds so.
+func (s *ResponseSniffer) Code() int {
+	if s.code == 0 {
+		return http.StatusOK
+	}
 	return s.code
 }
 
 // BodySize returns response body size
-func (s *responseSniffer) BodySize() int {
+func (s *ResponseSniffer) BodySize() int {
 	return s.bodySize
 }
 
 // Header returns Header object to write headers to.
-func (s *responseSniffer) Header() http.Header {
+func (s *ResponseSniffer) Header() http.Header {
 	return s.writer.Header()
 }
 
 // Write writes response body.
-func (s *responseSniffer) Write(body []byte) (int, error) {
+func (s *ResponseSniffer) Write(body []byte) (int, error) {
 	if s.code == 0 {
 		s.code = http.StatusOK
 	}
@@ -56,7 +96,7 @@ func (s *responseSniffer) Write(body []byte) (int, error) {
 }
 
 // WriteHeader writes status code.
-func (s *responseSniffer) WriteHeader(statusCode int) {
+func (s *ResponseSniffer) WriteHeader(statusCode int) {
 	s.code = statusCode
 	s.writer.WriteHeader(statusCode)
 }
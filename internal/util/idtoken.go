@@ -0,0 +1,211 @@
+package util
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ikedam/gtokenserver/log"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jws"
+)
+
+const (
+	defaultTokenURI = "https://oauth2.googleapis.com/token"
+
+	jwtBearerGrantType = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+)
+
+// authorizedUserEndpoint is replaced in tests
+var authorizedUserEndpoint = google.Endpoint
+
+// NewIDTokenSource returns a TokenSource providing OIDC ID tokens for the audience.
+// AccessToken of the returned tokens holds the ID token.
+//
+// includeEmail is applied only to impersonated and fake service accounts:
+// Google always includes email claims in tokens for service account keys and user accounts.
+// Tokens for "authorized_user" credentials are issued for the OAuth client
+// used to log in (e.g. gcloud) and audience cannot be applied to them.
+func NewIDTokenSource(
+	ctx context.Context,
+	cred *google.Credentials,
+	audience string,
+	includeEmail bool,
+) (oauth2.TokenSource, error) {
+	var c credentialsJSON
+	if err := json.Unmarshal(cred.JSON, &c); err != nil {
+		return nil, fmt.Errorf("Failed to parse credentials JSON: %w", err)
+	}
+
+	switch c.Type {
+	case typeAuthorizedUser:
+		log.WithField("audience", audience).
+			Warning("ID tokens for user accounts are issued for the OAuth client used to log in, and the audience is not applied")
+		return oauth2.ReuseTokenSource(nil, &authorizedUserIDTokenSource{
+			ctx:  ctx,
+			cred: &c,
+		}), nil
+	case typeServiceAccount:
+		key, err := parseRSAKey([]byte(c.PrivateKey))
+		if err != nil {
+			return nil, err
+		}
+		return oauth2.ReuseTokenSource(nil, &serviceAccountIDTokenSource{
+			ctx:      ctx,
+			cred:     &c,
+			key:      key,
+			audience: audience,
+		}), nil
+	case typeFakeServiceAccount:
+		key, err := parseRSAKey([]byte(c.PrivateKey))
+		if err != nil {
+			return nil, err
+		}
+		return oauth2.ReuseTokenSource(nil, &fakeIDTokenSource{
+			cred:         &c,
+			key:          key,
+			audience:     audience,
+			includeEmail: includeEmail,
+		}), nil
+	case typeImpersonatedServiceAccount:
+		var impersonated impersonatedCredentialsJSON
+		if err := json.Unmarshal(cred.JSON, &impersonated); err != nil {
+			return nil, fmt.Errorf("Failed to parse credentials JSON: %w", err)
+		}
+		return newImpersonatedIDTokenSource(ctx, &impersonated, audience, includeEmail)
+	}
+
+	return nil, fmt.Errorf("Unexpected type: %v", c.Type)
+}
+
+type idTokenResponse struct {
+	IDToken string `json:"id_token"`
+}
+
+type serviceAccountIDTokenSource struct {
+	ctx      context.Context
+	cred     *credentialsJSON
+	key      *rsa.PrivateKey
+	audience string
+}
+
+// Token exchanges a self-signed JWT with target_audience for an ID token signed by Google.
+func (s *serviceAccountIDTokenSource) Token() (*oauth2.Token, error) {
+	tokenURI := s.cred.TokenURI
+	if tokenURI == "" {
+		tokenURI = defaultTokenURI
+	}
+	now := time.Now()
+	claims := &jws.ClaimSet{
+		Iss: s.cred.ClientEmail,
+		Sub: s.cred.ClientEmail,
+		Aud: tokenURI,
+		Iat: now.Unix(),
+		Exp: now.Add(time.Hour).Unix(),
+		PrivateClaims: map[string]interface{}{
+			"target_audience": s.audience,
+		},
+	}
+	header := &jws.Header{
+		Algorithm: "RS256",
+		Typ:       "JWT",
+		KeyID:     s.cred.PrivateKeyID,
+	}
+	assertion, err := jws.Encode(header, claims, s.key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to sign JWT: %w", err)
+	}
+
+	c := oauth2.NewClient(s.ctx, nil)
+	rsp, err := c.PostForm(tokenURI, url.Values{
+		"grant_type": {jwtBearerGrantType},
+		"assertion":  {assertion},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to access the token endpoint: %w", err)
+	}
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read response from the token endpoint: %w", err)
+	}
+	if rsp.StatusCode != http.StatusOK {
+		log.WithField("status", rsp.StatusCode).
+			WithField("body", string(body)).
+			Debug("Unexpected response from token endpoint")
+		return nil, fmt.Errorf("Unexpected response from the token endpoint: %v", rsp.StatusCode)
+	}
+	var idToken idTokenResponse
+	if err := json.Unmarshal(body, &idToken); err != nil {
+		return nil, fmt.Errorf("Failed to parse response from the token endpoint: %w", err)
+	}
+	return newIDToken(idToken.IDToken)
+}
+
+type authorizedUserIDTokenSource struct {
+	ctx  context.Context
+	cred *credentialsJSON
+}
+
+// Token retrieves an ID token with the refresh token flow.
+func (s *authorizedUserIDTokenSource) Token() (*oauth2.Token, error) {
+	config := &oauth2.Config{
+		ClientID:     s.cred.ClientID,
+		ClientSecret: s.cred.ClientSecret,
+		Endpoint:     authorizedUserEndpoint,
+	}
+	token, err := config.TokenSource(s.ctx, &oauth2.Token{
+		RefreshToken: s.cred.RefreshToken,
+	}).Token()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to refresh token: %w", err)
+	}
+	idToken, ok := token.Extra("id_token").(string)
+	if !ok || idToken == "" {
+		return nil, errors.New("No id_token is returned: login again with `gcloud auth application-default login`")
+	}
+	return newIDToken(idToken)
+}
+
+// newIDToken wraps an ID token into oauth2.Token to be cached with oauth2.ReuseTokenSource.
+func newIDToken(idToken string) (*oauth2.Token, error) {
+	claims, err := jws.Decode(idToken)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode ID token: %w", err)
+	}
+	return &oauth2.Token{
+		AccessToken: idToken,
+		TokenType:   "Bearer",
+		Expiry:      time.Unix(claims.Exp, 0),
+	}, nil
+}
+
+// parseRSAKey parses PEM encoded private keys in service account keys.
+func parseRSAKey(key []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(key)
+	if block != nil {
+		key = block.Bytes
+	}
+	parsedKey, err := x509.ParsePKCS8PrivateKey(key)
+	if err != nil {
+		parsedKey, err = x509.ParsePKCS1PrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse private key: %w", err)
+		}
+	}
+	rsaKey, ok := parsedKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("Private key is not a RSA key")
+	}
+	return rsaKey, nil
+}
@@ -0,0 +1,79 @@
+package util
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jws"
+)
+
+func TestAuthorizedUserIDTokenSource(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate a key: %v", err)
+	}
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	idToken, err := jws.Encode(
+		&jws.Header{Algorithm: "RS256", Typ: "JWT"},
+		&jws.ClaimSet{Iss: "https://accounts.google.com", Aud: "gcloud", Exp: expiry.Unix()},
+		key,
+	)
+	if err != nil {
+		t.Fatalf("failed to sign the ID token: %v", err)
+	}
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse the request: %v", err)
+		}
+		if grantType := r.PostForm.Get("grant_type"); grantType != "refresh_token" {
+			t.Errorf("unexpected grant_type: %v", grantType)
+		}
+		if refreshToken := r.PostForm.Get("refresh_token"); refreshToken != "user-refresh-token" {
+			t.Errorf("unexpected refresh_token: %v", refreshToken)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "user-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	}))
+	defer tokenServer.Close()
+	originalEndpoint := authorizedUserEndpoint
+	authorizedUserEndpoint = oauth2.Endpoint{TokenURL: tokenServer.URL}
+	defer func() {
+		authorizedUserEndpoint = originalEndpoint
+	}()
+
+	cred := &google.Credentials{
+		JSON: []byte(`{
+			"type": "authorized_user",
+			"client_id": "client-id",
+			"client_secret": "client-secret",
+			"refresh_token": "user-refresh-token"
+		}`),
+	}
+	source, err := NewIDTokenSource(context.Background(), cred, "https://example.com", false)
+	if err != nil {
+		t.Fatalf("failed to create the token source: %v", err)
+	}
+	token, err := source.Token()
+	if err != nil {
+		t.Fatalf("failed to get the ID token: %v", err)
+	}
+	if token.AccessToken != idToken {
+		t.Errorf("expected the ID token from the refresh flow but got %v", token.AccessToken)
+	}
+	if !token.Expiry.Equal(expiry) {
+		t.Errorf("expected expiry %v but got %v", expiry, token.Expiry)
+	}
+}
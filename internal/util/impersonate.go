@@ -0,0 +1,256 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ikedam/gtokenserver/log"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	typeImpersonatedServiceAccount = "impersonated_service_account"
+
+	// CloudPlatformScope is the scope required to call IAM Credentials API.
+	CloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+	iamCredentialsEndpoint = "https://iamcredentials.googleapis.com/v1/"
+)
+
+// impersonatedCredentialsJSON is the format gcloud uses for
+// `gcloud auth application-default login --impersonate-service-account`.
+type impersonatedCredentialsJSON struct {
+	Type                           string          `json:"type"`
+	ServiceAccountImpersonationURL string          `json:"service_account_impersonation_url"`
+	Delegates                      []string        `json:"delegates,omitempty"`
+	SourceCredentials              json.RawMessage `json:"source_credentials"`
+}
+
+func (c *impersonatedCredentialsJSON) email() (string, error) {
+	u, err := url.Parse(c.ServiceAccountImpersonationURL)
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse service_account_impersonation_url: %w", err)
+	}
+	path := u.Path
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		path = path[i+1:]
+	}
+	if i := strings.Index(path, ":"); i >= 0 {
+		path = path[:i]
+	}
+	if path == "" {
+		return "", fmt.Errorf("Unexpected service_account_impersonation_url: %v", c.ServiceAccountImpersonationURL)
+	}
+	return path, nil
+}
+
+// ImpersonateCredentials returns credentials impersonating the target service account.
+// source must be credentials with the cloud-platform scope.
+// Tokens are issued with IAM Credentials API:
+// https://cloud.google.com/iam/docs/reference/credentials/rest
+func ImpersonateCredentials(
+	ctx context.Context,
+	source *google.Credentials,
+	target string,
+	delegates []string,
+	scopes ...string,
+) (*google.Credentials, error) {
+	jsonBody, err := json.Marshal(&impersonatedCredentialsJSON{
+		Type: typeImpersonatedServiceAccount,
+		ServiceAccountImpersonationURL: fmt.Sprintf(
+			"%vprojects/-/serviceAccounts/%v:generateAccessToken",
+			iamCredentialsEndpoint,
+			target,
+		),
+		Delegates:         delegates,
+		SourceCredentials: source.JSON,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to build credentials JSON: %w", err)
+	}
+	return &google.Credentials{
+		ProjectID: source.ProjectID,
+		TokenSource: oauth2.ReuseTokenSource(nil, &impersonatedTokenSource{
+			ctx:       ctx,
+			source:    source.TokenSource,
+			target:    target,
+			delegates: delegates,
+			scopes:    scopes,
+		}),
+		JSON: jsonBody,
+	}, nil
+}
+
+type generateAccessTokenRequest struct {
+	Delegates []string `json:"delegates,omitempty"`
+	Scope     []string `json:"scope"`
+	Lifetime  string   `json:"lifetime,omitempty"`
+}
+
+type generateAccessTokenResponse struct {
+	AccessToken string    `json:"accessToken"`
+	ExpireTime  time.Time `json:"expireTime"`
+}
+
+type impersonatedTokenSource struct {
+	ctx       context.Context
+	source    oauth2.TokenSource
+	target    string
+	delegates []string
+	scopes    []string
+}
+
+// Token issues an access token with generateAccessToken.
+func (s *impersonatedTokenSource) Token() (*oauth2.Token, error) {
+	var rsp generateAccessTokenResponse
+	if err := callIAMCredentials(
+		s.ctx,
+		s.source,
+		s.target,
+		"generateAccessToken",
+		&generateAccessTokenRequest{
+			Delegates: delegatesToResourceNames(s.delegates),
+			Scope:     s.scopes,
+		},
+		&rsp,
+	); err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{
+		AccessToken: rsp.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      rsp.ExpireTime,
+	}, nil
+}
+
+type generateIDTokenRequest struct {
+	Delegates    []string `json:"delegates,omitempty"`
+	Audience     string   `json:"audience"`
+	IncludeEmail bool     `json:"includeEmail"`
+}
+
+type generateIDTokenResponse struct {
+	Token string `json:"token"`
+}
+
+type impersonatedIDTokenSource struct {
+	ctx          context.Context
+	source       oauth2.TokenSource
+	target       string
+	delegates    []string
+	audience     string
+	includeEmail bool
+}
+
+// Token issues an ID token with generateIdToken.
+func (s *impersonatedIDTokenSource) Token() (*oauth2.Token, error) {
+	var rsp generateIDTokenResponse
+	if err := callIAMCredentials(
+		s.ctx,
+		s.source,
+		s.target,
+		"generateIdToken",
+		&generateIDTokenRequest{
+			Delegates:    delegatesToResourceNames(s.delegates),
+			Audience:     s.audience,
+			IncludeEmail: s.includeEmail,
+		},
+		&rsp,
+	); err != nil {
+		return nil, err
+	}
+	return newIDToken(rsp.Token)
+}
+
+func newImpersonatedIDTokenSource(
+	ctx context.Context,
+	c *impersonatedCredentialsJSON,
+	audience string,
+	includeEmail bool,
+) (oauth2.TokenSource, error) {
+	target, err := c.email()
+	if err != nil {
+		return nil, err
+	}
+	source, err := google.CredentialsFromJSON(ctx, c.SourceCredentials, CloudPlatformScope)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load source credentials: %w", err)
+	}
+	return oauth2.ReuseTokenSource(nil, &impersonatedIDTokenSource{
+		ctx:          ctx,
+		source:       source.TokenSource,
+		target:       target,
+		delegates:    c.Delegates,
+		audience:     audience,
+		includeEmail: includeEmail,
+	}), nil
+}
+
+// delegatesToResourceNames converts emails of delegates to resource names.
+func delegatesToResourceNames(delegates []string) []string {
+	if len(delegates) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(delegates))
+	for _, delegate := range delegates {
+		if strings.HasPrefix(delegate, "projects/") {
+			names = append(names, delegate)
+			continue
+		}
+		names = append(names, fmt.Sprintf("projects/-/serviceAccounts/%v", delegate))
+	}
+	return names
+}
+
+func callIAMCredentials(
+	ctx context.Context,
+	source oauth2.TokenSource,
+	target string,
+	method string,
+	request interface{},
+	response interface{},
+) error {
+	reqBody, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("Failed to build request to %v: %w", method, err)
+	}
+	c := oauth2.NewClient(ctx, source)
+	rsp, err := c.Post(
+		fmt.Sprintf(
+			"%vprojects/-/serviceAccounts/%v:%v",
+			iamCredentialsEndpoint,
+			url.PathEscape(target),
+			method,
+		),
+		"application/json",
+		bytes.NewReader(reqBody),
+	)
+	if err != nil {
+		return fmt.Errorf("Failed to access %v: %w", method, err)
+	}
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return fmt.Errorf("Failed to read response from %v: %w", method, err)
+	}
+	if rsp.StatusCode != http.StatusOK {
+		log.WithField("status", rsp.StatusCode).
+			WithField("body", string(body)).
+			WithField("method", method).
+			Debug("Unexpected response from IAM Credentials API")
+		return fmt.Errorf("Unexpected response from %v: %v", method, rsp.StatusCode)
+	}
+	if err := json.Unmarshal(body, response); err != nil {
+		return fmt.Errorf("Failed to parse response from %v: %w", method, err)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package util
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
+)
+
+// httpClient is the client for requests to Google.
+// Requests are traced with the global tracer provider if configured.
+var httpClient = &http.Client{
+	Transport: otelhttp.NewTransport(http.DefaultTransport),
+}
+
+// HTTPContext returns a context making oauth2 and google packages send requests with traced clients.
+// Requests are traced as children of the span in ctx, but not canceled with ctx
+// as results are shared with other requests and cached.
+func HTTPContext(ctx context.Context) context.Context {
+	detached := trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+	return context.WithValue(detached, oauth2.HTTPClient, httpClient)
+}
@@ -0,0 +1,100 @@
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// journaldSocket is the socket of systemd-journald for the native protocol
+const journaldSocket = "/run/systemd/journal/socket"
+
+// journaldHook sends logs to systemd-journald with fields as journal fields.
+// See https://systemd.io/JOURNAL_NATIVE_PROTOCOL/ for the protocol.
+type journaldHook struct {
+	conn net.Conn
+}
+
+func newJournaldHook() (*journaldHook, error) {
+	conn, err := net.Dial("unixgram", journaldSocket)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to journald: %w", err)
+	}
+	return &journaldHook{conn: conn}, nil
+}
+
+func (h *journaldHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *journaldHook) Fire(entry *logrus.Entry) error {
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", entry.Message)
+	writeJournalField(&b, "PRIORITY", fmt.Sprint(journalPriority(entry.Level)))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", "gtokenserver")
+	for key, value := range entry.Data {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		writeJournalField(&b, journalFieldName(key), fmt.Sprint(value))
+	}
+	_, err := h.conn.Write(b.Bytes())
+	return err
+}
+
+func (h *journaldHook) Close() error {
+	return h.conn.Close()
+}
+
+// journalPriority maps levels to syslog severities.
+func journalPriority(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 2 // crit
+	case logrus.ErrorLevel:
+		return 3 // err
+	case logrus.WarnLevel:
+		return 4 // warning
+	case logrus.InfoLevel:
+		return 6 // info
+	}
+	return 7 // debug
+}
+
+// journalFieldName converts key to a valid journal field name like REQUEST_ID.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	// Fields starting with underscores are reserved for journald.
+	return strings.TrimLeft(name, "_0123456789")
+}
+
+// writeJournalField writes a field in the native protocol.
+// Values with newlines are written in the binary form.
+func writeJournalField(b *bytes.Buffer, name string, value string) {
+	if name == "" {
+		return
+	}
+	b.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
@@ -2,18 +2,41 @@
 package log
 
 import (
+	"context"
 	"fmt"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 )
 
+// Names of fields attached consistently to logs.
+const (
+	// FieldRequestID is the ID of the HTTP request
+	FieldRequestID = "request_id"
+	// FieldClient is the address of the client
+	FieldClient = "client"
+	// FieldAccount is the name of the service account
+	FieldAccount = "account"
+	// FieldScopes is scopes of tokens
+	FieldScopes = "scopes"
+)
+
+// Names of log formats.
+const (
+	FormatText   = "text"
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
 var (
 	// Logger is the logger used in gtokenserver. You can replace or configure it as you like.
+	// Secrets in logs are redacted with a hook, which is lost if you replace hooks.
 	Logger *logrus.Logger
 )
 
 func init() {
 	Logger = logrus.New()
+	Logger.AddHook(&redactHook{})
 }
 
 // Debug outputs debug logs.
@@ -82,6 +105,27 @@ func WithField(key string, value interface{}) *logrus.Entry {
 
 }
 
+// WithFields prepares log outputs with the specified fields.
+func WithFields(fields logrus.Fields) *logrus.Entry {
+	return Logger.WithFields(fields)
+}
+
+var entryKey = "logEntry"
+
+// NewContext returns a context carrying entry.
+// Logs with FromContext have fields of entry.
+func NewContext(ctx context.Context, entry *logrus.Entry) context.Context {
+	return context.WithValue(ctx, &entryKey, entry)
+}
+
+// FromContext prepares log outputs with fields carried by ctx (e.g. request_id of HTTP requests).
+func FromContext(ctx context.Context) *logrus.Entry {
+	if entry, ok := ctx.Value(&entryKey).(*logrus.Entry); ok {
+		return entry
+	}
+	return logrus.NewEntry(Logger)
+}
+
 // SetLevelByName configures the log level with specified name.
 func SetLevelByName(level string) error {
 	l, err := logrus.ParseLevel(level)
@@ -91,3 +135,22 @@ func SetLevelByName(level string) error {
 	Logger.SetLevel(l)
 	return nil
 }
+
+// SetFormatByName configures the log format with specified name: text, json or logfmt.
+// text is colored when writing to terminals. logfmt is always plain.
+func SetFormatByName(format string) error {
+	switch strings.ToLower(format) {
+	case "", FormatText:
+		Logger.SetFormatter(&logrus.TextFormatter{})
+	case FormatJSON:
+		Logger.SetFormatter(&logrus.JSONFormatter{})
+	case FormatLogfmt:
+		Logger.SetFormatter(&logrus.TextFormatter{
+			DisableColors: true,
+			FullTimestamp: true,
+		})
+	default:
+		return fmt.Errorf("Invalid log format %v: must be text, json or logfmt", format)
+	}
+	return nil
+}
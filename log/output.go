@@ -0,0 +1,109 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Names of log outputs other than files.
+const (
+	OutputStderr   = "stderr"
+	OutputStdout   = "stdout"
+	OutputSyslog   = "syslog"
+	OutputJournald = "journald"
+)
+
+// OutputConfig is a configuration of the log output
+type OutputConfig struct {
+	// Output is stderr, stdout, syslog, journald or a path to a file.
+	Output string
+	// MaxSize is the size in megabytes to rotate the file. Files are never rotated if 0.
+	MaxSize int
+	// MaxBackups is the number of rotated files to keep.
+	MaxBackups int
+}
+
+var (
+	outputMutex   sync.Mutex
+	currentOutput OutputConfig
+	// closer closes the current output if needed
+	closer io.Closer
+	// sinkHook is the hook sending logs to syslog or journald
+	sinkHook logrus.Hook
+)
+
+// SetOutput configures the log output.
+// It does nothing if the output is not changed.
+func SetOutput(config OutputConfig) error {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	if config.Output == "" {
+		config.Output = OutputStderr
+	}
+	if config == currentOutput {
+		return nil
+	}
+
+	var out io.Writer = os.Stderr
+	var newCloser io.Closer
+	var newHook logrus.Hook
+	switch strings.ToLower(config.Output) {
+	case OutputStderr:
+	case OutputStdout:
+		out = os.Stdout
+	case OutputSyslog:
+		hook, err := newSyslogHook()
+		if err != nil {
+			return err
+		}
+		out, newCloser, newHook = ioutil.Discard, hook, hook
+	case OutputJournald:
+		hook, err := newJournaldHook()
+		if err != nil {
+			return err
+		}
+		out, newCloser, newHook = ioutil.Discard, hook, hook
+	default:
+		file, err := openRotatingFile(config.Output, int64(config.MaxSize)*1024*1024, config.MaxBackups)
+		if err != nil {
+			return err
+		}
+		out, newCloser = file, file
+	}
+
+	replaceSinkHook(newHook)
+	Logger.SetOutput(out)
+	if closer != nil {
+		closer.Close()
+	}
+	closer = newCloser
+	currentOutput = config
+	return nil
+}
+
+// replaceSinkHook replaces sinkHook keeping other hooks.
+func replaceSinkHook(hook logrus.Hook) {
+	hooks := make(logrus.LevelHooks)
+	for level, levelHooks := range Logger.Hooks {
+		for _, h := range levelHooks {
+			if h != sinkHook {
+				hooks[level] = append(hooks[level], h)
+			}
+		}
+	}
+	if hook != nil {
+		hooks.Add(hook)
+	}
+	Logger.ReplaceHooks(hooks)
+	sinkHook = hook
+}
+
+func unsupportedOutputError(output string) error {
+	return fmt.Errorf("Log output %v is not supported on this platform", output)
+}
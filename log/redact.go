@@ -0,0 +1,122 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// redacted replaces secrets in logs
+const redacted = "[REDACTED]"
+
+// redactPatterns are secrets scrubbed from messages and fields.
+// Patterns are applied in order.
+var redactPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// PEM private keys, also with escaped newlines in JSON.
+	{
+		regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----(?s:.*?)-----END [A-Z ]*PRIVATE KEY-----`),
+		"[REDACTED PRIVATE KEY]",
+	},
+	// Secret values in JSON like credential files and token responses.
+	{
+		regexp.MustCompile(`("(?:access_token|refresh_token|id_token|client_secret|private_key)"\s*:\s*)"(?:[^"\\]|\\.)*"`),
+		`${1}"` + redacted + `"`,
+	},
+	// Secret values in form encoding like token requests.
+	{
+		regexp.MustCompile(`\b((?:access_token|refresh_token|id_token|client_secret|assertion)=)[^&\s"]+`),
+		"${1}" + redacted,
+	},
+	// Authorization headers.
+	{
+		regexp.MustCompile(`(?i)\b(Bearer\s+)[^\s"]+`),
+		"${1}" + redacted,
+	},
+	// JWTs like ID tokens and assertions.
+	{
+		regexp.MustCompile(`\beyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+		"[REDACTED JWT]",
+	},
+	// Google OAuth2 access tokens and refresh tokens.
+	{
+		regexp.MustCompile(`\bya29\.[A-Za-z0-9_.-]+`),
+		"ya29." + redacted,
+	},
+	{
+		regexp.MustCompile(`\b1//[A-Za-z0-9_-]+`),
+		"1//" + redacted,
+	},
+}
+
+// redactFields are names of fields always redacted.
+var redactFields = map[string]bool{
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"id_token":      true,
+	"private_key":   true,
+	"client_secret": true,
+	"authorization": true,
+	"password":      true,
+}
+
+// Redact scrubs access tokens, refresh tokens, private keys and JWTs from text.
+func Redact(text string) string {
+	for _, p := range redactPatterns {
+		text = p.re.ReplaceAllString(text, p.repl)
+	}
+	return text
+}
+
+// redactHook scrubs secrets from messages and fields of all logs.
+// It's installed first so that other hooks like syslog and journald
+// receive redacted logs.
+type redactHook struct{}
+
+func (h *redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *redactHook) Fire(entry *logrus.Entry) error {
+	entry.Message = Redact(entry.Message)
+	// Data may be shared with the parent entry, and must not be modified.
+	data := make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		data[key] = redactValue(key, value)
+	}
+	entry.Data = data
+	return nil
+}
+
+// redactValue returns value as is if it has no secrets,
+// otherwise returns redacted text.
+func redactValue(key string, value interface{}) interface{} {
+	if redactFields[strings.ToLower(key)] {
+		return redacted
+	}
+	switch v := value.(type) {
+	case nil, bool, int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64, float32, float64,
+		time.Time, time.Duration:
+		return value
+	case string:
+		return Redact(v)
+	case error:
+		if text := Redact(v.Error()); text != v.Error() {
+			return errors.New(text)
+		}
+		return value
+	}
+	text := fmt.Sprintf("%+v", value)
+	if redactedText := Redact(text); redactedText != text {
+		return redactedText
+	}
+	return value
+}
@@ -0,0 +1,52 @@
+// +build !windows,!plan9
+
+package log
+
+import (
+	"log/syslog"
+
+	"github.com/sirupsen/logrus"
+)
+
+// syslogTag is the tag of logs sent to syslog
+const syslogTag = "gtokenserver"
+
+// syslogHook sends logs to the local syslog daemon.
+// Logs are formatted with the formatter of Logger.
+type syslogHook struct {
+	writer *syslog.Writer
+}
+
+func newSyslogHook() (*syslogHook, error) {
+	writer, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, syslogTag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogHook{writer: writer}, nil
+}
+
+func (h *syslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *syslogHook) Fire(entry *logrus.Entry) error {
+	line, err := entry.String()
+	if err != nil {
+		return err
+	}
+	switch entry.Level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return h.writer.Crit(line)
+	case logrus.ErrorLevel:
+		return h.writer.Err(line)
+	case logrus.WarnLevel:
+		return h.writer.Warning(line)
+	case logrus.InfoLevel:
+		return h.writer.Info(line)
+	}
+	return h.writer.Debug(line)
+}
+
+func (h *syslogHook) Close() error {
+	return h.writer.Close()
+}
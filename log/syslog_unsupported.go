@@ -0,0 +1,26 @@
+// +build windows plan9
+
+package log
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// syslogHook is not available on this platform
+type syslogHook struct{}
+
+func newSyslogHook() (*syslogHook, error) {
+	return nil, unsupportedOutputError(OutputSyslog)
+}
+
+func (h *syslogHook) Levels() []logrus.Level {
+	return nil
+}
+
+func (h *syslogHook) Fire(entry *logrus.Entry) error {
+	return nil
+}
+
+func (h *syslogHook) Close() error {
+	return nil
+}
@@ -0,0 +1,432 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ikedam/gtokenserver/internal/util"
+	"github.com/ikedam/gtokenserver/log"
+
+	"golang.org/x/oauth2/google"
+	"golang.org/x/sync/singleflight"
+)
+
+// ServiceAccountConfig is a configuration of a service account served by the server
+type ServiceAccountConfig struct {
+	// Alias is an additional name to access the service account in addition to the email
+	Alias string
+	// Default marks the service account served as "default"
+	Default bool
+	// Scopes defaults to Config.Scopes
+	Scopes                       []string
+	CloudSDKConfig               string   `mapstructure:"cloudsdk-config"`
+	GoogleApplicationCredentials string   `mapstructure:"google-application-credentials"`
+	ImpersonateServiceAccount    string   `mapstructure:"impersonate-service-account"`
+	ImpersonateDelegates         []string `mapstructure:"impersonate-delegates"`
+	// Email is the email of the service account in the fake mode.
+	// Defaults to <alias>@<project>.iam.gserviceaccount.com
+	Email string
+}
+
+// serviceAccount resolves and caches credentials of a configured service account.
+// It's safe for concurrent use.
+type serviceAccount struct {
+	config  ServiceAccountConfig
+	project string
+	// fallbackToDefault allows to use google.FindDefaultCredentials
+	// when specified credentials are not available.
+	fallbackToDefault bool
+	// fake is non-nil in the fake mode
+	fake *fakeIssuer
+	// tokens caches credentials for requested scopes
+	tokens *tokenCache
+
+	// lookups deduplicates concurrent lookups of credentials for the same scopes.
+	lookups singleflight.Group
+
+	// mutex protects fields below
+	mutex sync.Mutex
+	cache *cachedDefaultCredentials
+	// stamp identifies credentials files the cache is loaded from
+	stamp                            string
+	checkedAt                        time.Time
+	warnGoogleApplicationCredentials bool
+	warnCoudSDKConfig                bool
+}
+
+func newServiceAccount(
+	config ServiceAccountConfig,
+	project string,
+	fallbackToDefault bool,
+	fake *fakeIssuer,
+	tokens *tokenCache,
+) *serviceAccount {
+	return &serviceAccount{
+		config:            config,
+		project:           project,
+		fallbackToDefault: fallbackToDefault,
+		fake:              fake,
+		tokens:            tokens,
+	}
+}
+
+// shouldWarn returns true only for the first call after resetWarning.
+func (a *serviceAccount) shouldWarn(warned *bool) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if *warned {
+		return false
+	}
+	*warned = true
+	return true
+}
+
+func (a *serviceAccount) resetWarning(warned *bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	*warned = false
+}
+
+// name returns a name to identify the service account in logs.
+func (a *serviceAccount) name() string {
+	if a.config.Alias != "" {
+		return a.config.Alias
+	}
+	if a.config.ImpersonateServiceAccount != "" {
+		return a.config.ImpersonateServiceAccount
+	}
+	if a.fake != nil {
+		return a.config.Email
+	}
+	if a.config.GoogleApplicationCredentials != "" {
+		return a.config.GoogleApplicationCredentials
+	}
+	if a.config.CloudSDKConfig != "" {
+		return a.config.CloudSDKConfig
+	}
+	return "application default credentials"
+}
+
+func (a *serviceAccount) credentialsFromFile(ctx context.Context, file string, scopes ...string) (*google.Credentials, error) {
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from %v: %w", file, err)
+	}
+	return google.CredentialsFromJSON(ctx, body, scopes...)
+}
+
+// findCredentials returns credentials and where they're loaded from.
+func (a *serviceAccount) findCredentials(scopes ...string) (*google.Credentials, string, error) {
+	if a.fake != nil {
+		cred, err := a.fake.credentials(a.config.Email, scopes...)
+		return cred, credentialsSourceFake, err
+	}
+	if a.config.ImpersonateServiceAccount == "" {
+		return a.findSourceCredentials(scopes...)
+	}
+	// Source credentials require the cloud-platform scope to call IAM Credentials API.
+	source, sourceName, err := a.findSourceCredentials(util.CloudPlatformScope)
+	if err != nil {
+		return nil, "", err
+	}
+	cred, err := util.ImpersonateCredentials(
+		util.HTTPContext(context.Background()),
+		source,
+		a.config.ImpersonateServiceAccount,
+		a.config.ImpersonateDelegates,
+		scopes...,
+	)
+	return cred, sourceName, err
+}
+
+func (a *serviceAccount) findSourceCredentials(scopes ...string) (*google.Credentials, string, error) {
+	ctx := util.HTTPContext(context.Background())
+	if a.config.GoogleApplicationCredentials != "" {
+		file, err := os.Stat(a.config.GoogleApplicationCredentials)
+		if !os.IsNotExist(err) && !file.IsDir() {
+			cred, err := a.credentialsFromFile(ctx, a.config.GoogleApplicationCredentials, scopes...)
+			if err == nil { // Be careful: not != but ==
+				a.resetWarning(&a.warnGoogleApplicationCredentials)
+				return cred, a.config.GoogleApplicationCredentials, nil
+			}
+			if !a.fallbackToDefault {
+				return nil, "", fmt.Errorf("failed to load %v: %w", a.config.GoogleApplicationCredentials, err)
+			}
+			if a.shouldWarn(&a.warnGoogleApplicationCredentials) {
+				log.WithError(err).
+					WithField(log.FieldAccount, a.name()).
+					WithField("file", a.config.GoogleApplicationCredentials).
+					Warning("Failed to load specified credentials file: ignored.")
+			}
+		} else {
+			if !a.fallbackToDefault {
+				return nil, "", fmt.Errorf("failed to stat %v", a.config.GoogleApplicationCredentials)
+			}
+			if a.shouldWarn(&a.warnGoogleApplicationCredentials) {
+				log.WithField(log.FieldAccount, a.name()).
+					WithField("file", a.config.GoogleApplicationCredentials).
+					Warning("Failed to stat specified credentials file: ignored.")
+			}
+		}
+	}
+	// Fails only for explicitly specified configurations when fallback is not allowed.
+	strict := !a.fallbackToDefault && a.config.CloudSDKConfig != ""
+	cloudSDKConfig := a.config.CloudSDKConfig
+	if cloudSDKConfig == "" {
+		// CLOUDSDK_CONFIG doesn't supported in golang oauth2 library.
+		// See: https://github.com/googleapis/google-cloud-go/issues/288
+		cloudSDKConfig = os.Getenv("CLOUDSDK_CONFIG")
+	}
+	if cloudSDKConfig != "" {
+		applicationConfig := filepath.Join(cloudSDKConfig, "application_default_credentials.json")
+		file, err := os.Stat(applicationConfig)
+		if !os.IsNotExist(err) && !file.IsDir() {
+			cred, err := a.credentialsFromFile(ctx, applicationConfig, scopes...)
+			if err == nil { // Be careful: not != but ==
+				a.resetWarning(&a.warnCoudSDKConfig)
+				return cred, applicationConfig, nil
+			}
+			if strict {
+				return nil, "", fmt.Errorf("failed to load %v: %w", applicationConfig, err)
+			}
+			if a.shouldWarn(&a.warnCoudSDKConfig) {
+				log.WithError(err).
+					WithField(log.FieldAccount, a.name()).
+					WithField("directory", applicationConfig).
+					Warning("Failed to load credentials from specified cloud-sdk configuration directory: ignored.")
+			}
+		} else if strict {
+			return nil, "", fmt.Errorf("failed to stat %v", applicationConfig)
+		}
+	}
+	cred, err := google.FindDefaultCredentials(ctx, scopes...)
+	return cred, defaultCredentialsSource(), err
+}
+
+// Scopes returns scopes for tokens of the service account.
+func (a *serviceAccount) Scopes() []string {
+	return a.config.Scopes
+}
+
+// getCredentials returns credentials for the scopes, or for the configured scopes if not specified.
+// Credentials for the configured scopes are reloaded only when credentials files are changed.
+// Concurrent calls for the same scopes share the single lookup.
+// Lookups of the email are traced as children of the span in ctx.
+func (a *serviceAccount) getCredentials(ctx context.Context, scopes ...string) *cachedDefaultCredentials {
+	if scopes != nil {
+		return a.getScopedCredentials(ctx, normalizeScopes(scopes))
+	}
+	if cached := a.cachedIfUnchanged(); cached != nil {
+		return cached
+	}
+	cred, _, _ := a.lookups.Do("", func() (interface{}, error) {
+		return a.lookupCredentials(ctx), nil
+	})
+	return cred.(*cachedDefaultCredentials)
+}
+
+// cachedCredentials returns the credentials for the configured scopes loaded last.
+func (a *serviceAccount) cachedCredentials() *cachedDefaultCredentials {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.cache
+}
+
+// getScopedCredentials returns credentials for the scopes from the token cache.
+// Cached credentials are discarded when credentials of the account are reloaded.
+func (a *serviceAccount) getScopedCredentials(ctx context.Context, scopes []string) *cachedDefaultCredentials {
+	if a.getCredentials(ctx) == nil {
+		return nil
+	}
+	a.mutex.Lock()
+	key := tokenCacheKey{
+		account: a,
+		stamp:   a.stamp,
+		scopes:  strings.Join(scopes, " "),
+	}
+	a.mutex.Unlock()
+	if cred := a.tokens.get(key); cred != nil {
+		return cred
+	}
+	cred, _, _ := a.lookups.Do("scopes:"+key.scopes, func() (interface{}, error) {
+		cred := a.lookupCredentials(ctx, scopes...)
+		if cred != nil {
+			a.tokens.add(key, cred)
+		}
+		return cred, nil
+	})
+	return cred.(*cachedDefaultCredentials)
+}
+
+func (a *serviceAccount) lookupCredentials(ctx context.Context, scopes ...string) *cachedDefaultCredentials {
+	actualScopes := scopes
+	if scopes == nil {
+		actualScopes = a.config.Scopes
+	}
+	// Stamp before loading not to miss changes while loading.
+	stamp := credentialsStamp(a.credentialsFiles())
+	cred, source, err := a.findCredentials(actualScopes...)
+	if err != nil {
+		if !a.fallbackToDefault {
+			log.WithError(err).
+				WithField(log.FieldAccount, a.name()).
+				Error("Could not retrieve credentials of the service account")
+			return nil
+		}
+		log.WithError(err).
+			Error(
+				"Could not retrieve default credentials\n" +
+					"You may haven't set up credentials. You can set up your credentials in one of those ways:\n" +
+					"\n" +
+					"  * Run `gcloud auth application-default login`. Share /root/.config/gcloud with volume mounts in docker containers.\n" +
+					"  * Put the service account key file (a json file), and specify the path with GOOGLE_APPLICATION_CREDENTIALS environment variable.\n" +
+					"\n\n",
+			)
+		return nil
+	}
+	newCache, err := newCachedDefaultCredentials(cred, a.project)
+	if err != nil {
+		log.WithError(err).
+			WithField(log.FieldAccount, a.name()).
+			Error("Could not resolve default credentials")
+		return nil
+	}
+	if a.fake != nil {
+		newCache.numericProjectID = a.fake.numericProjectID
+	}
+	newCache.Source = source
+	newCache.account = a.name()
+	newCache.scopes = strings.Join(normalizeScopes(actualScopes), " ")
+	newCache.scopesLabel = scopesLabelConfigured
+	if scopes != nil {
+		newCache.scopesLabel = scopesLabelRequested
+	}
+	newCache.renew = func() (*google.Credentials, error) {
+		cred, _, err := a.findCredentials(actualScopes...)
+		return cred, err
+	}
+	if scopes != nil {
+		// Cached by the caller.
+		return newCache
+	}
+	a.mutex.Lock()
+	a.cache = newCache
+	a.stamp = stamp
+	a.checkedAt = time.Now()
+	a.mutex.Unlock()
+	email, err := newCache.GetEmail(ctx)
+	logger := log.WithField(log.FieldAccount, a.name()).
+		WithField("source", source)
+	if err == nil { // Be careful: not err != nil, but err == nil
+		logger.WithField("email", email).Info("New credentials")
+	} else {
+		logger.WithField("client_id", newCache.ClientID).Info("New credentials")
+	}
+	return newCache
+}
+
+// buildServiceAccounts builds service accounts from the configuration.
+// Without service-accounts, the server serves the single service account
+// configured with top-level options just as the earlier versions.
+// fake is nil unless in the fake mode.
+func buildServiceAccounts(config *Config, fake *fakeIssuer, tokens *tokenCache) ([]*serviceAccount, error) {
+	project := config.Project
+	if fake != nil {
+		project = fake.project
+	}
+	if len(config.ServiceAccounts) == 0 {
+		email := config.Fake.Email
+		if email == "" {
+			email = config.ImpersonateServiceAccount
+		}
+		if email == "" && fake != nil {
+			email = fake.defaultEmail("gtokenserver")
+		}
+		return []*serviceAccount{
+			newServiceAccount(
+				ServiceAccountConfig{
+					Default:                      true,
+					Scopes:                       config.Scopes,
+					CloudSDKConfig:               config.CloudSDKConfig,
+					GoogleApplicationCredentials: config.GoogleApplicationCredentials,
+					ImpersonateServiceAccount:    config.ImpersonateServiceAccount,
+					ImpersonateDelegates:         config.ImpersonateDelegates,
+					Email:                        email,
+				},
+				project,
+				true,
+				fake,
+				tokens,
+			),
+		}, nil
+	}
+
+	accounts := make([]*serviceAccount, 0, len(config.ServiceAccounts))
+	hasDefault := false
+	aliases := make(map[string]bool)
+	for _, accountConfig := range config.ServiceAccounts {
+		if accountConfig.Default {
+			if hasDefault {
+				return nil, fmt.Errorf("multiple service accounts are marked as default")
+			}
+			hasDefault = true
+		}
+		if accountConfig.Alias != "" {
+			if accountConfig.Alias == "default" {
+				return nil, fmt.Errorf("alias \"default\" is reserved: use default: true instead")
+			}
+			if aliases[accountConfig.Alias] {
+				return nil, fmt.Errorf("duplicate alias: %v", accountConfig.Alias)
+			}
+			aliases[accountConfig.Alias] = true
+		}
+		if accountConfig.Scopes == nil {
+			accountConfig.Scopes = config.Scopes
+		}
+		if fake != nil && accountConfig.Email == "" {
+			switch {
+			case accountConfig.ImpersonateServiceAccount != "":
+				accountConfig.Email = accountConfig.ImpersonateServiceAccount
+			case accountConfig.Alias != "":
+				accountConfig.Email = fake.defaultEmail(accountConfig.Alias)
+			default:
+				return nil, fmt.Errorf("email or alias is required for service accounts in the fake mode")
+			}
+		}
+		accounts = append(accounts, newServiceAccount(accountConfig, project, false, fake, tokens))
+	}
+	if !hasDefault {
+		accounts[0].config.Default = true
+	}
+	return accounts, nil
+}
+
+// reuseServiceAccounts replaces accounts with previous ones with the same configuration
+// to keep their cached credentials across reloads.
+func reuseServiceAccounts(accounts []*serviceAccount, previous []*serviceAccount) {
+	used := make(map[*serviceAccount]bool)
+	for i, account := range accounts {
+		for _, p := range previous {
+			if !used[p] && account.sameAs(p) {
+				accounts[i] = p
+				used[p] = true
+				break
+			}
+		}
+	}
+}
+
+func (a *serviceAccount) sameAs(other *serviceAccount) bool {
+	return reflect.DeepEqual(a.config, other.config) &&
+		a.project == other.project &&
+		a.fallbackToDefault == other.fallbackToDefault &&
+		a.fake == other.fake &&
+		a.tokens == other.tokens
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/ikedam/gtokenserver/internal/util"
+	"github.com/ikedam/gtokenserver/log"
+)
+
+// AdminConfig is a configuration of the admin API
+type AdminConfig struct {
+	// Host defaults to localhost
+	Host string
+	// Port to bind. The admin API is disabled if not specified.
+	Port int
+	// Token is required in requests as "Authorization: Bearer <token>"
+	Token string
+}
+
+func (c *AdminConfig) validate() error {
+	if c.Port == 0 {
+		return nil
+	}
+	if c.Token == "" {
+		return fmt.Errorf("admin.token is required to enable the admin API")
+	}
+	return nil
+}
+
+const adminMetadataPrefix = "/metadata/"
+
+func (s *Server) buildAdminRouter() http.Handler {
+	r := mux.NewRouter()
+	r.Use(s.adminAuthMiddleware)
+	r.PathPrefix(adminMetadataPrefix).Methods(http.MethodGet).HandlerFunc(s.handleAdminGetMetadata)
+	r.PathPrefix(adminMetadataPrefix).Methods(http.MethodPut).HandlerFunc(s.handleAdminSetMetadata)
+	r.PathPrefix(adminMetadataPrefix).Methods(http.MethodDelete).HandlerFunc(s.handleAdminDeleteMetadata)
+	r.HandleFunc("/overrides", s.handleAdminGetOverrides).Methods(http.MethodGet)
+	r.HandleFunc("/overrides", s.handleAdminResetOverrides).Methods(http.MethodDelete)
+	r.HandleFunc("/notify", s.handleAdminNotify).Methods(http.MethodPost)
+	r.HandleFunc("/stats", s.handleAdminStats).Methods(http.MethodGet)
+	r.Handle(metricsPath, s.handleMetrics()).Methods(http.MethodGet)
+	return r
+}
+
+// serveAdmin launches the admin API if configured.
+// It's stopped with the server.
+func (s *Server) serveAdmin() error {
+	if s.config.Admin.Port == 0 {
+		return nil
+	}
+	host := s.config.Admin.Host
+	if host == "" {
+		host = "localhost"
+	}
+	hostport := fmt.Sprintf("%v:%v", host, s.config.Admin.Port)
+	addr, err := net.Listen("tcp", hostport)
+	if err != nil {
+		return fmt.Errorf("failed to listen %v: %w", hostport, err)
+	}
+	srv := &http.Server{
+		Handler: util.InstallHTTPLogger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.running.get().adminRouter.ServeHTTP(w, r)
+		})),
+	}
+	s.running.addHTTPServer(srv)
+	log.WithField("address", addr.Addr().String()).Info("Listening for the admin API")
+	go func() {
+		if err := srv.Serve(addr); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("Admin API stopped")
+		}
+	}()
+	return nil
+}
+
+func (s *Server) adminAuthMiddleware(next http.Handler) http.Handler {
+	expected := []byte("Bearer " + s.config.Admin.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actual := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(actual, expected) != 1 {
+			log.FromContext(r.Context()).
+				WithField("method", r.Method).
+				WithField("path", r.URL.Path).
+				Warning("Unauthorized access to the admin API")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminRequest returns the request to build the metadata tree for the admin API.
+// Admins see all service accounts.
+func (s *Server) adminRequest(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), &clientProfileKey, s.allAccounts()))
+}
+
+func (s *Server) handleAdminGetMetadata(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, adminMetadataPrefix)
+	node, _, err := lookupMetadata(s.buildMetadataTree(s.adminRequest(r)), path)
+	if err != nil {
+		log.FromContext(r.Context()).
+			WithError(err).
+			WithField("path", path).
+			Error("Could not resolve the metadata")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if node == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	value, err := metadataToJSON(node)
+	if err != nil {
+		log.FromContext(r.Context()).
+			WithError(err).
+			WithField("path", path).
+			Error("Could not resolve the metadata")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.writeJSONResponse(w, value)
+}
+
+// handleAdminSetMetadata sets the value at the path.
+// The request body is used as a string value,
+// or parsed as JSON with "Content-Type: application/json":
+// objects are set as directories.
+func (s *Server) handleAdminSetMetadata(w http.ResponseWriter, r *http.Request) {
+	path := splitMetadataPath(strings.TrimPrefix(r.URL.Path, adminMetadataPrefix))
+	if len(path) == 0 {
+		s.writeErrorResponse(w, http.StatusBadRequest, "path is required")
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("failed to read the request: %v", err))
+		return
+	}
+	var raw interface{} = string(body)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&raw); err != nil {
+			s.writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("failed to parse the request: %v", err))
+			return
+		}
+	}
+	s.overrides.set(path, jsonToMetadata(raw), raw)
+	log.FromContext(r.Context()).
+		WithField("path", strings.Join(path, "/")).
+		Info("Metadata is set with the admin API")
+	s.metadataChanged.notify()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleAdminDeleteMetadata(w http.ResponseWriter, r *http.Request) {
+	path := splitMetadataPath(strings.TrimPrefix(r.URL.Path, adminMetadataPrefix))
+	if len(path) == 0 {
+		s.writeErrorResponse(w, http.StatusBadRequest, "path is required")
+		return
+	}
+	s.overrides.set(path, nil, nil)
+	log.FromContext(r.Context()).
+		WithField("path", strings.Join(path, "/")).
+		Info("Metadata is deleted with the admin API")
+	s.metadataChanged.notify()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type adminOverrideResponse struct {
+	Path    string      `json:"path"`
+	Value   interface{} `json:"value,omitempty"`
+	Deleted bool        `json:"deleted,omitempty"`
+}
+
+func (s *Server) handleAdminGetOverrides(w http.ResponseWriter, r *http.Request) {
+	response := []*adminOverrideResponse{}
+	for _, override := range s.overrides.list() {
+		response = append(response, &adminOverrideResponse{
+			Path:    strings.Join(override.path, "/"),
+			Value:   override.raw,
+			Deleted: override.value == nil,
+		})
+	}
+	s.writeJSONResponse(w, response)
+}
+
+func (s *Server) handleAdminResetOverrides(w http.ResponseWriter, r *http.Request) {
+	s.overrides.reset()
+	log.FromContext(r.Context()).Info("Metadata is reset with the admin API")
+	s.metadataChanged.notify()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminNotify wakes up wait_for_change requests to re-evaluate values.
+func (s *Server) handleAdminNotify(w http.ResponseWriter, r *http.Request) {
+	s.metadataChanged.notify()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type adminStatsResponse struct {
+	TokenCache tokenCacheStats `json:"tokenCache"`
+}
+
+func (s *Server) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	s.writeJSONResponse(w, &adminStatsResponse{
+		TokenCache: s.tokens.getStats(),
+	})
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// Attributes are custom metadata.
+// Each value is one of:
+//
+//   - a string: used as is.
+//   - a map with "value": used as is.
+//   - a map with "file": the content of the file. It's read for each access.
+//   - a map with "env": the value of the environment variable.
+//     The attribute is not served if the environment variable is not defined.
+type Attributes map[string]interface{}
+
+// resolveAttribute returns the value of the attribute.
+// The second return value is false if the attribute is not available.
+func resolveAttribute(name string, value interface{}) (string, bool, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", true, nil
+	case string:
+		return v, true, nil
+	case map[string]interface{}:
+		if literal, ok := v["value"]; ok {
+			return fmt.Sprint(literal), true, nil
+		}
+		if file, ok := v["file"]; ok {
+			body, err := ioutil.ReadFile(fmt.Sprint(file))
+			if err != nil {
+				return "", false, fmt.Errorf("failed to read attribute %v from %v: %w", name, file, err)
+			}
+			return string(body), true, nil
+		}
+		if env, ok := v["env"]; ok {
+			value, ok := os.LookupEnv(fmt.Sprint(env))
+			return value, ok, nil
+		}
+		return "", false, fmt.Errorf("attribute %v requires one of value, file or env", name)
+	}
+	return fmt.Sprint(value), true, nil
+}
+
+// resolveAll returns all available attributes.
+func (a Attributes) resolveAll() (map[string]string, error) {
+	values := make(map[string]string, len(a))
+	for name, value := range a {
+		resolved, ok, err := resolveAttribute(name, value)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			values[name] = resolved
+		}
+	}
+	return values, nil
+}
+
+// directory returns the metadata directory serving the attributes.
+func (a Attributes) directory() metadataLazyDirectory {
+	return func() (*metadataDirectory, error) {
+		values, err := a.resolveAll()
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		dir := &metadataDirectory{
+			custom: true,
+		}
+		for _, name := range names {
+			dir.entries = append(dir.entries, metadataEntryOf(name, constantValue(values[name])))
+		}
+		return dir, nil
+	}
+}
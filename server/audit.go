@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ikedam/gtokenserver/internal/util"
+	"github.com/ikedam/gtokenserver/log"
+)
+
+// AuditConfig is a configuration of the audit log of issued tokens
+type AuditConfig struct {
+	// File is the JSONL file to append records to. The audit log is disabled if not specified.
+	File string
+}
+
+const (
+	auditRouteToken    = "token"
+	auditRouteIdentity = "identity"
+
+	auditOutcomeIssued = "issued"
+	auditOutcomeDenied = "denied"
+	auditOutcomeFailed = "failed"
+)
+
+// auditRecord is a record of the audit log for a response of /token or /identity
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId,omitempty"`
+	Client    string    `json:"client"`
+	// Endpoint is token or identity
+	Endpoint string `json:"endpoint"`
+	// Account is the email of the service account, or the requested name if not resolved
+	Account  string   `json:"account"`
+	Scopes   []string `json:"scopes,omitempty"`
+	Audience string   `json:"audience,omitempty"`
+	// Fingerprint is the SHA-256 hash of the token. Tokens are never recorded.
+	Fingerprint string     `json:"fingerprint,omitempty"`
+	Expiry      *time.Time `json:"expiry,omitempty"`
+	// Outcome is issued, denied or failed
+	Outcome string `json:"outcome"`
+	Status  int    `json:"status"`
+}
+
+// auditor appends records to the audit log.
+// It's safe for concurrent use, and does nothing if nil.
+type auditor struct {
+	path string
+
+	// mutex protects fields below
+	mutex sync.Mutex
+	// file is nil after closed
+	file *os.File
+	// refs is the number of requests in progress to record
+	refs   int
+	closed bool
+}
+
+func newAuditor(config AuditConfig) (*auditor, error) {
+	if config.File == "" {
+		return nil, nil
+	}
+	file, err := openAuditFile(config.File)
+	if err != nil {
+		return nil, err
+	}
+	return &auditor{
+		path: config.File,
+		file: file,
+	}, nil
+}
+
+func openAuditFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the audit log %v: %w", path, err)
+	}
+	return file, nil
+}
+
+// acquire marks a request in progress to record.
+// The file is kept open until release is called.
+func (a *auditor) acquire() {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.refs++
+}
+
+func (a *auditor) release() {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.refs--
+	if a.closed && a.refs == 0 {
+		a.closeFile()
+	}
+}
+
+// Close closes the file after requests in progress are recorded.
+func (a *auditor) Close() {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.closed = true
+	if a.refs == 0 {
+		a.closeFile()
+	}
+}
+
+// closeFile must be called with mutex held.
+func (a *auditor) closeFile() {
+	if a.file == nil {
+		return
+	}
+	if err := a.file.Close(); err != nil {
+		log.WithError(err).
+			WithField("file", a.path).
+			Error("Failed to close the audit log")
+	}
+	a.file = nil
+}
+
+func (a *auditor) record(record *auditRecord) {
+	if a == nil {
+		return
+	}
+	body, err := json.Marshal(record)
+	if err != nil {
+		log.WithError(err).Error("Failed to serialize the audit record")
+		return
+	}
+	body = append(body, '\n')
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.file == nil {
+		// Requests started just before closing are recorded to the reopened file.
+		file, err := openAuditFile(a.path)
+		if err != nil {
+			log.WithError(err).Error("Failed to reopen the audit log")
+			return
+		}
+		a.file = file
+	}
+	if _, err := a.file.Write(body); err != nil {
+		log.WithError(err).
+			WithField("file", a.path).
+			Error("Failed to write to the audit log")
+	}
+}
+
+// tokenFingerprint returns the hash to identify the token without revealing it.
+func tokenFingerprint(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
+
+// idTokenExpiry returns the exp claim of the ID token, or nil if not available.
+func idTokenExpiry(token string) *time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return nil
+	}
+	return optionalTime(time.Unix(claims.Exp, 0))
+}
+
+var auditRecordKey = "auditRecord"
+
+// getAuditRecordFromContext returns nil if the request is not audited.
+func getAuditRecordFromContext(ctx context.Context) *auditRecord {
+	record, _ := ctx.Value(&auditRecordKey).(*auditRecord)
+	return record
+}
+
+// auditMiddleware records responses of routes named auditRouteToken and auditRouteIdentity.
+// Handlers fill the record in the context.
+// It's installed before clientMiddleware to record denied clients.
+func (s *Server) auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if s.audit == nil || route == nil ||
+			(route.GetName() != auditRouteToken && route.GetName() != auditRouteIdentity) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		s.audit.acquire()
+		defer s.audit.release()
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		record := &auditRecord{
+			RequestID: w.Header().Get(util.RequestIDHeader),
+			Client:    client,
+			Endpoint:  route.GetName(),
+			Account:   mux.Vars(r)["account"],
+		}
+		sniffer := util.NewResponseSniffer(w)
+		next.ServeHTTP(sniffer, r.WithContext(context.WithValue(r.Context(), &auditRecordKey, record)))
+
+		record.Time = time.Now()
+		record.Status = sniffer.Code()
+		switch {
+		case record.Status == http.StatusOK:
+			record.Outcome = auditOutcomeIssued
+		case record.Status == http.StatusForbidden || record.Status == http.StatusNotFound:
+			record.Outcome = auditOutcomeDenied
+		default:
+			record.Outcome = auditOutcomeFailed
+		}
+		s.audit.record(record)
+	})
+}
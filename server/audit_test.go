@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAuditorClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gtokenserver")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+	a, err := newAuditor(AuditConfig{File: path})
+	if err != nil {
+		t.Fatalf("failed to open the audit log: %v", err)
+	}
+
+	// A request in progress when closed
+	a.acquire()
+	a.Close()
+	if a.file == nil {
+		t.Errorf("closed while a request is in progress")
+	}
+	a.record(&auditRecord{RequestID: "in-progress"})
+	a.release()
+	if a.file != nil {
+		t.Errorf("not closed after the request finished")
+	}
+
+	// A request started just before closed
+	a.acquire()
+	a.record(&auditRecord{RequestID: "late"})
+	a.release()
+	if a.file != nil {
+		t.Errorf("not closed after the late request finished")
+	}
+
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read the audit log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	if len(lines) != 2 ||
+		!strings.Contains(lines[0], `"requestId":"in-progress"`) ||
+		!strings.Contains(lines[1], `"requestId":"late"`) {
+		t.Errorf("unexpected audit log: %q", body)
+	}
+}
+
+func TestAuditRecordScopes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gtokenserver")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+	ts := newFakeTestServer(t, &Config{Audit: AuditConfig{File: path}})
+
+	for _, path := range []string{
+		"/instance/service-accounts/default/token",
+		"/instance/service-accounts/default/token?scopes=https://www.googleapis.com/auth/userinfo.email,https://www.googleapis.com/auth/cloud-platform",
+	} {
+		if code, body := getMetadata(t, ts, path); code != http.StatusOK {
+			t.Fatalf("expected %v but got %v: %v", http.StatusOK, code, body)
+		}
+	}
+
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read the audit log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected audit log: %q", body)
+	}
+	for i, expected := range [][]string{
+		nil,
+		{"https://www.googleapis.com/auth/cloud-platform", "https://www.googleapis.com/auth/userinfo.email"},
+	} {
+		var record auditRecord
+		if err := json.Unmarshal([]byte(lines[i]), &record); err != nil {
+			t.Fatalf("failed to parse %q: %v", lines[i], err)
+		}
+		if !reflect.DeepEqual(record.Scopes, expected) {
+			t.Errorf("expected scopes %q but got %q", expected, record.Scopes)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"container/list"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -8,19 +9,64 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/ikedam/gtokenserver/internal/util"
 	"github.com/ikedam/gtokenserver/log"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"golang.org/x/sync/singleflight"
 )
 
+// maxIDTokenSources is the maximum number of audiences to cache ID tokens for each credentials.
+// Audiences are specified by clients and must be bounded.
+const maxIDTokenSources = 100
+
+// getEmailOfCredentials is replaced in tests to count lookups.
+var getEmailOfCredentials = util.GetEmailOfCredentials
+
+// cachedDefaultCredentials caches values resolved from credentials.
+// It's safe for concurrent use.
 type cachedDefaultCredentials struct {
-	Credentials      *google.Credentials
-	ClientID         string
-	ProjectID        string
+	Credentials *google.Credentials
+	ClientID    string
+	ProjectID   string
+	// Source is the file credentials are loaded from, "fake" or "metadata server"
+	Source string
+	// account and scopes identify credentials in logs
+	account string
+	scopes  string
+	// scopesLabel is the scopes label of metrics:
+	// scopesLabelConfigured or scopesLabelRequested not to expose scopes specified by clients
+	scopesLabel string
+
+	// lookups deduplicates concurrent lookups of lazily resolved values
+	lookups singleflight.Group
+
+	// mutex protects fields below
+	mutex            sync.Mutex
 	email            string
 	numericProjectID int64
+
+	// idTokenSources is a LRU cache of ID token sources for audiences
+	idTokenSources map[string]*list.Element
+	idTokenLRU     *list.List
+	idTokenMutex   sync.Mutex
+
+	// renew creates new credentials to refresh tokens in background.
+	// Tokens are refreshed only when they expire if nil.
+	renew func() (*google.Credentials, error)
+	// tokenMutex protects fields below
+	tokenMutex  sync.Mutex
+	tokenSource oauth2.TokenSource
+	expiry      time.Time
+	usedAt      time.Time
+	refreshing  bool
+	failures    int
+	nextRefresh time.Time
+	// warnedExpiry is the expiry of the token warned not to be renewed
+	warnedExpiry time.Time
 }
 
 func newCachedDefaultCredentials(credentials *google.Credentials, projectID string) (*cachedDefaultCredentials, error) {
@@ -35,44 +81,83 @@ func newCachedDefaultCredentials(credentials *google.Credentials, projectID stri
 		Credentials: credentials,
 		ClientID:    clientID,
 		ProjectID:   projectID,
+
+		idTokenSources: make(map[string]*list.Element),
+		idTokenLRU:     list.New(),
+		tokenSource:    credentials.TokenSource,
+		usedAt:         time.Now(),
 	}, nil
 }
 
-func (c *cachedDefaultCredentials) GetEmail() (string, error) {
-	if c.email != "" {
-		return c.email, nil
-	}
-	email, err := util.GetEmailOfCredentials(c.Credentials)
-	if err != nil {
-		return "", err
+// GetEmail returns the email of the credentials.
+// The lookup is traced as a child of the span in ctx.
+func (c *cachedDefaultCredentials) GetEmail(ctx context.Context) (string, error) {
+	c.mutex.Lock()
+	email := c.email
+	c.mutex.Unlock()
+	if email != "" {
+		return email, nil
 	}
-	c.email = email
-	return email, nil
+	resolved, err, _ := c.lookups.Do("email", func() (interface{}, error) {
+		start := time.Now()
+		email, err := getEmailOfCredentials(ctx, c.Credentials)
+		observeUpstreamRequest(upstreamCallEmail, start, err)
+		if err != nil {
+			return "", err
+		}
+		c.mutex.Lock()
+		c.email = email
+		c.mutex.Unlock()
+		return email, nil
+	})
+	return resolved.(string), err
 }
 
 type projectResponseHolder struct {
 	ProjectNumber string `json:"projectNumber"`
 }
 
-func (c *cachedDefaultCredentials) GetNumericProjectID() (int64, error) {
+// GetNumericProjectID returns the project number of the project.
+// The lookup is traced as a child of the span in ctx.
+func (c *cachedDefaultCredentials) GetNumericProjectID(ctx context.Context) (int64, error) {
 	if c.ProjectID == "" {
 		return 0, nil
 	}
-	if c.numericProjectID != 0 {
-		return c.numericProjectID, nil
+	c.mutex.Lock()
+	numericProjectID := c.numericProjectID
+	c.mutex.Unlock()
+	if numericProjectID != 0 {
+		return numericProjectID, nil
 	}
+	resolved, err, _ := c.lookups.Do("numericProjectID", func() (interface{}, error) {
+		start := time.Now()
+		numericProjectID, err := c.lookupNumericProjectID(ctx)
+		observeUpstreamRequest(upstreamCallProjectNumber, start, err)
+		if err != nil {
+			return int64(0), err
+		}
+		c.mutex.Lock()
+		c.numericProjectID = numericProjectID
+		c.mutex.Unlock()
+		return numericProjectID, nil
+	})
+	return resolved.(int64), err
+}
 
+func (c *cachedDefaultCredentials) lookupNumericProjectID(ctx context.Context) (int64, error) {
 	// https://cloud.google.com/resource-manager/reference/rest/v1/projects/get
 	// It sounds really strange, but you need to enable API for service accounts.
 	// It always works for authorized users.
-	client := oauth2.NewClient(
-		context.Background(),
-		c.Credentials.TokenSource,
-	)
-	rsp, err := client.Get(fmt.Sprintf(
+	ctx = util.HTTPContext(ctx)
+	client := oauth2.NewClient(ctx, c.Credentials.TokenSource)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(
 		"https://cloudresourcemanager.googleapis.com/v1/projects/%v",
 		url.PathEscape(c.ProjectID),
-	))
+	), nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve numeric project number: %w", err)
+	}
+	rsp, err := client.Do(req)
 	if err != nil {
 		return 0, fmt.Errorf("failed to resolve numeric project number: %w", err)
 	}
@@ -84,14 +169,14 @@ func (c *cachedDefaultCredentials) GetNumericProjectID() (int64, error) {
 	if rsp.StatusCode != http.StatusOK {
 		log.WithField("status", rsp.StatusCode).
 			WithField("body", string(body)).
-			Debugf("Unexpected response from project endpoint")
+			Debug("Unexpected response from project endpoint")
 		return 0, fmt.Errorf("unexpected response from project endpoint: %v", rsp.StatusCode)
 	}
 
 	var projectResponse projectResponseHolder
 	if err := json.Unmarshal(body, &projectResponse); err != nil {
 		log.WithField("body", string(body)).
-			Debugf("Unexpected response from project endpoint")
+			Debug("Unexpected response from project endpoint")
 		return 0, fmt.Errorf("unexpected response from project endpoint: %v", rsp.StatusCode)
 	}
 
@@ -100,10 +185,92 @@ func (c *cachedDefaultCredentials) GetNumericProjectID() (int64, error) {
 		return 0, fmt.Errorf("unexpected response from project endpoint: %w", err)
 	}
 
-	c.numericProjectID = numericProjectID
 	return numericProjectID, nil
 }
 
-func (c *cachedDefaultCredentials) Token() (*oauth2.Token, error) {
-	return c.Credentials.TokenSource.Token()
+// Token returns the token in memory unless it expires.
+// Tokens are refreshed in background before they expire (see refreshTokens).
+// The span in ctx is the parent of the span to get the token.
+// Requests to mint tokens are traced separately, as token sources are shared by requests.
+func (c *cachedDefaultCredentials) Token(ctx context.Context) (*oauth2.Token, error) {
+	_, span := tracer.Start(ctx, "token")
+	c.tokenMutex.Lock()
+	source := c.tokenSource
+	c.usedAt = time.Now()
+	c.tokenMutex.Unlock()
+	token, err := source.Token()
+	if err != nil {
+		tokenMintFailuresTotal.WithLabelValues(c.account, c.scopesLabel, tokenMintRequest).Inc()
+		endSpan(span, err)
+		return nil, err
+	}
+	c.tokenMutex.Lock()
+	minted := token.Expiry.After(c.expiry)
+	if minted {
+		// A new token is issued.
+		tokenMintsTotal.WithLabelValues(c.account, c.scopesLabel, tokenMintRequest).Inc()
+		c.expiry = token.Expiry
+	}
+	c.tokenMutex.Unlock()
+	span.SetAttributes(attributeTokenMinted.Bool(minted))
+	endSpan(span, nil)
+	return token, nil
+}
+
+// tokenExpiry returns the expiry of the token issued last.
+// It returns zero if no tokens are issued yet.
+func (c *cachedDefaultCredentials) tokenExpiry() time.Time {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+	return c.expiry
+}
+
+// idTokenSourceEntry is an entry of idTokenSources
+type idTokenSourceEntry struct {
+	key    string
+	source oauth2.TokenSource
+}
+
+// IDToken returns an ID token for the audience.
+// ID tokens are cached for maxIDTokenSources audiences used recently.
+// The span in ctx is the parent of the span to get the ID token.
+// Requests to mint ID tokens are traced separately, as token sources are shared by requests.
+func (c *cachedDefaultCredentials) IDToken(ctx context.Context, audience string, includeEmail bool) (string, error) {
+	_, span := tracer.Start(ctx, "identity-token")
+	token, err := c.idToken(audience, includeEmail)
+	endSpan(span, err)
+	return token, err
+}
+
+func (c *cachedDefaultCredentials) idToken(audience string, includeEmail bool) (string, error) {
+	key := fmt.Sprintf("%v:%v", includeEmail, audience)
+	c.idTokenMutex.Lock()
+	var source oauth2.TokenSource
+	if element, ok := c.idTokenSources[key]; ok {
+		c.idTokenLRU.MoveToFront(element)
+		source = element.Value.(*idTokenSourceEntry).source
+	} else {
+		var err error
+		source, err = util.NewIDTokenSource(util.HTTPContext(context.Background()), c.Credentials, audience, includeEmail)
+		if err != nil {
+			c.idTokenMutex.Unlock()
+			return "", err
+		}
+		c.idTokenSources[key] = c.idTokenLRU.PushFront(&idTokenSourceEntry{
+			key:    key,
+			source: source,
+		})
+		for c.idTokenLRU.Len() > maxIDTokenSources {
+			oldest := c.idTokenLRU.Back()
+			c.idTokenLRU.Remove(oldest)
+			delete(c.idTokenSources, oldest.Value.(*idTokenSourceEntry).key)
+		}
+	}
+	c.idTokenMutex.Unlock()
+
+	token, err := source.Token()
+	if err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
 }
@@ -0,0 +1,372 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ikedam/gtokenserver/log"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// ClientConfig maps clients to a service account
+type ClientConfig struct {
+	// Addresses are IP addresses or CIDRs of clients
+	Addresses []string
+	// Containers are names of docker containers.
+	// They're matched with reverse lookups of client addresses,
+	// which works only when gtokenserver runs in the same docker network.
+	Containers []string
+	// ServiceAccount is the alias or the email of the service account for the clients.
+	// The service account is served as "default" and only it is visible to the clients.
+	ServiceAccount string `mapstructure:"service-account"`
+}
+
+const (
+	// unmatchedClientsDeny is the value of Config.UnmatchedClients to deny unmatched clients
+	unmatchedClientsDeny = "deny"
+
+	reverseLookupTTL = time.Minute
+	// reverseLookupTimeout limits the time to wait for DNS not to block requests
+	reverseLookupTimeout = 2 * time.Second
+)
+
+// clientProfile is a set of service accounts visible to a client
+type clientProfile struct {
+	accounts       []*serviceAccount
+	defaultAccount *serviceAccount
+}
+
+// findAccount returns the service account with the name.
+// name can be "default", an alias or an email.
+// Lookups of emails are traced as children of the span in ctx.
+func (p *clientProfile) findAccount(ctx context.Context, name string) *serviceAccount {
+	if name == "default" {
+		return p.defaultAccount
+	}
+	for _, account := range p.accounts {
+		if account.config.Alias == name {
+			return account
+		}
+	}
+	for _, account := range p.accounts {
+		cred := account.getCredentials(ctx)
+		if cred == nil {
+			continue
+		}
+		email, err := cred.GetEmail(ctx)
+		if err != nil {
+			log.WithError(err).
+				WithField(log.FieldAccount, account.name()).
+				Error("Could not retrieve email of the credential")
+			continue
+		}
+		if email == name {
+			return account
+		}
+	}
+	return nil
+}
+
+// aliasesOf returns names other than the email to access the service account.
+func (p *clientProfile) aliasesOf(account *serviceAccount) []string {
+	aliases := []string{}
+	if account == p.defaultAccount {
+		aliases = append(aliases, "default")
+	}
+	if account.config.Alias != "" {
+		aliases = append(aliases, account.config.Alias)
+	}
+	return aliases
+}
+
+type clientMatcher struct {
+	config   ClientConfig
+	networks []*net.IPNet
+}
+
+func newClientMatcher(config ClientConfig) (*clientMatcher, error) {
+	if config.ServiceAccount == "" {
+		return nil, fmt.Errorf("service-account is required for clients")
+	}
+	networks := make([]*net.IPNet, 0, len(config.Addresses))
+	for _, address := range config.Addresses {
+		if !strings.Contains(address, "/") {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address for clients: %v", address)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address for clients: %v: %w", address, err)
+		}
+		networks = append(networks, network)
+	}
+	return &clientMatcher{
+		config:   config,
+		networks: networks,
+	}, nil
+}
+
+func (m *clientMatcher) matchAddress(ip net.IP) bool {
+	for _, network := range m.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *clientMatcher) matchNames(names []string) bool {
+	for _, container := range m.config.Containers {
+		for _, name := range names {
+			// Docker resolves container addresses to "container.network."
+			name = strings.TrimSuffix(name, ".")
+			if name == container || strings.HasPrefix(name, container+".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type reverseLookupResult struct {
+	names  []string
+	expire time.Time
+}
+
+// clientResolver resolves service accounts for clients
+type clientResolver struct {
+	matchers  []*clientMatcher
+	unmatched string
+
+	// lookups deduplicates concurrent reverse lookups of the same address.
+	lookups singleflight.Group
+
+	// lookupMutex protects lookupCache, and is not held while looking up.
+	lookupMutex sync.Mutex
+	lookupCache map[string]*reverseLookupResult
+}
+
+func newClientResolver(config *Config, accounts []*serviceAccount) (*clientResolver, error) {
+	matchers := make([]*clientMatcher, 0, len(config.Clients))
+	for _, clientConfig := range config.Clients {
+		matcher, err := newClientMatcher(clientConfig)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkClientAccount(clientConfig.ServiceAccount, accounts); err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, matcher)
+	}
+	if len(matchers) > 0 && config.UnmatchedClients != "" && config.UnmatchedClients != unmatchedClientsDeny {
+		if err := checkClientAccount(config.UnmatchedClients, accounts); err != nil {
+			return nil, err
+		}
+	}
+	return &clientResolver{
+		matchers:    matchers,
+		unmatched:   config.UnmatchedClients,
+		lookupCache: make(map[string]*reverseLookupResult),
+	}, nil
+}
+
+// checkClientAccount returns an error if name doesn't refer to any of accounts.
+// Emails not in the configuration can be verified only with credentials,
+// and are warned instead.
+func checkClientAccount(name string, accounts []*serviceAccount) error {
+	if name == "default" {
+		return nil
+	}
+	verifiable := true
+	for _, account := range accounts {
+		if account.config.Alias == name ||
+			account.config.Email == name ||
+			account.config.ImpersonateServiceAccount == name {
+			return nil
+		}
+		if account.config.Email == "" && account.config.ImpersonateServiceAccount == "" {
+			verifiable = false
+		}
+	}
+	if verifiable || !strings.Contains(name, "@") {
+		return fmt.Errorf("service account for clients is not configured: %v", name)
+	}
+	log.WithField(log.FieldAccount, name).
+		Warning("Service account for clients is not found in the configuration: it must be the email of credentials")
+	return nil
+}
+
+func (c *clientResolver) lookupNames(ip net.IP) []string {
+	key := ip.String()
+	c.lookupMutex.Lock()
+	cached, ok := c.lookupCache[key]
+	c.lookupMutex.Unlock()
+	if ok && time.Now().Before(cached.expire) {
+		return cached.names
+	}
+	result, _, _ := c.lookups.Do(key, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), reverseLookupTimeout)
+		defer cancel()
+		names, err := net.DefaultResolver.LookupAddr(ctx, key)
+		if err != nil {
+			log.WithError(err).
+				WithField(log.FieldClient, key).
+				Debug("Failed to lookup the client address")
+		}
+		c.lookupMutex.Lock()
+		defer c.lookupMutex.Unlock()
+		c.lookupCache[key] = &reverseLookupResult{
+			names:  names,
+			expire: time.Now().Add(reverseLookupTTL),
+		}
+		return names, nil
+	})
+	return result.([]string)
+}
+
+// resolve returns the name of the service account for the client.
+// It returns "" for the default service account.
+func (c *clientResolver) resolve(ip net.IP) (string, bool) {
+	if len(c.matchers) == 0 {
+		return "", true
+	}
+	for _, matcher := range c.matchers {
+		if matcher.matchAddress(ip) {
+			return matcher.config.ServiceAccount, true
+		}
+	}
+	var names []string
+	for _, matcher := range c.matchers {
+		if len(matcher.config.Containers) == 0 {
+			continue
+		}
+		if names == nil {
+			names = c.lookupNames(ip)
+		}
+		if matcher.matchNames(names) {
+			return matcher.config.ServiceAccount, true
+		}
+	}
+	return c.resolveUnmatched()
+}
+
+// resolveUnmatched returns the name of the service account for clients without addresses.
+func (c *clientResolver) resolveUnmatched() (string, bool) {
+	if len(c.matchers) == 0 {
+		return "", true
+	}
+	if c.unmatched == unmatchedClientsDeny {
+		return "", false
+	}
+	return c.unmatched, true
+}
+
+// allAccounts returns the profile containing all service accounts.
+func (s *Server) allAccounts() *clientProfile {
+	profile := &clientProfile{
+		accounts:       s.accounts,
+		defaultAccount: s.accounts[0],
+	}
+	for _, account := range s.accounts {
+		if account.config.Default {
+			profile.defaultAccount = account
+			break
+		}
+	}
+	return profile
+}
+
+var clientProfileKey = "clientProfile"
+
+var errClientDenied = errors.New("client denied")
+
+// resolveClientProfile returns the profile for the client of the request.
+// It returns errClientDenied for clients not allowed.
+func (s *Server) resolveClientProfile(r *http.Request) (*clientProfile, error) {
+	var client string
+	var name string
+	var ok bool
+	if isUnixSocketRequest(r) {
+		// Clients of Unix sockets are controlled with file permissions.
+		client = "unix"
+		name, ok = s.clients.resolveUnmatched()
+	} else {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			log.FromContext(r.Context()).
+				Warning("Could not parse the client address")
+			return nil, errClientDenied
+		}
+		if ip.To4() != nil {
+			ip = ip.To4()
+		}
+		client = ip.String()
+		name, ok = s.clients.resolve(ip)
+	}
+	if !ok {
+		log.FromContext(r.Context()).
+			WithField(log.FieldClient, client).
+			Warning("Denied unmatched client")
+		return nil, errClientDenied
+	}
+	profile := s.allAccounts()
+	if name != "" {
+		account := profile.findAccount(r.Context(), name)
+		if account == nil {
+			log.FromContext(r.Context()).
+				WithField(log.FieldClient, client).
+				WithField(log.FieldAccount, name).
+				Error("Could not find the service account for the client")
+			return nil, errClientDenied
+		}
+		profile = &clientProfile{
+			accounts:       []*serviceAccount{account},
+			defaultAccount: account,
+		}
+	}
+	return profile, nil
+}
+
+// withClientProfile returns the request with the profile for the client.
+func (s *Server) withClientProfile(r *http.Request) (*http.Request, error) {
+	profile, err := s.resolveClientProfile(r)
+	if err != nil {
+		return nil, err
+	}
+	return r.WithContext(context.WithValue(r.Context(), &clientProfileKey, profile)), nil
+}
+
+func (s *Server) clientMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, err := s.withClientProfile(r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) getClientProfileFromContext(ctx context.Context) *clientProfile {
+	return ctx.Value(&clientProfileKey).(*clientProfile)
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// secretConfigFields are fields whose values are not logged
+var secretConfigFields = map[string]bool{
+	"Token":                        true,
+	"KeyFile":                      true,
+	"GoogleApplicationCredentials": true,
+}
+
+// redactedConfigValue replaces values of secretConfigFields in logs
+const redactedConfigValue = "[REDACTED]"
+
+// configKey returns the key of the field in configuration files.
+func configKey(field reflect.StructField) string {
+	if tag := field.Tag.Get("mapstructure"); tag != "" {
+		return strings.Split(tag, ",")[0]
+	}
+	return strings.ToLower(field.Name)
+}
+
+// diffConfig returns descriptions of changed values like "admin.port: 0 -> 8081".
+func diffConfig(prefix string, previous, next reflect.Value) []string {
+	if previous.Kind() == reflect.Struct {
+		var diffs []string
+		for i := 0; i < previous.NumField(); i++ {
+			field := previous.Type().Field(i)
+			key := configKey(field)
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			if secretConfigFields[field.Name] {
+				if !reflect.DeepEqual(previous.Field(i).Interface(), next.Field(i).Interface()) {
+					diffs = append(diffs, fmt.Sprintf("%v: (changed)", key))
+				}
+				continue
+			}
+			diffs = append(diffs, diffConfig(key, previous.Field(i), next.Field(i))...)
+		}
+		return diffs
+	}
+	if reflect.DeepEqual(previous.Interface(), next.Interface()) {
+		return nil
+	}
+	switch previous.Kind() {
+	case reflect.Slice:
+		if previous.Len() == next.Len() && previous.Type().Elem().Kind() == reflect.Struct {
+			var diffs []string
+			for i := 0; i < previous.Len(); i++ {
+				diffs = append(diffs, diffConfig(fmt.Sprintf("%v.%v", prefix, i), previous.Index(i), next.Index(i))...)
+			}
+			return diffs
+		}
+	case reflect.Map:
+		return diffConfigMap(prefix, previous, next)
+	}
+	return []string{fmt.Sprintf("%v: %v -> %v", prefix, formatConfig(previous), formatConfig(next))}
+}
+
+// diffConfigMap describes changed values for each key.
+func diffConfigMap(prefix string, previous, next reflect.Value) []string {
+	keys := make(map[string]reflect.Value)
+	for _, key := range previous.MapKeys() {
+		keys[fmt.Sprint(key.Interface())] = key
+	}
+	for _, key := range next.MapKeys() {
+		keys[fmt.Sprint(key.Interface())] = key
+	}
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var diffs []string
+	for _, name := range names {
+		previousValue := previous.MapIndex(keys[name])
+		nextValue := next.MapIndex(keys[name])
+		key := prefix + "." + name
+		switch {
+		case !previousValue.IsValid():
+			diffs = append(diffs, fmt.Sprintf("%v: (none) -> %v", key, formatConfig(nextValue)))
+		case !nextValue.IsValid():
+			diffs = append(diffs, fmt.Sprintf("%v: %v -> (none)", key, formatConfig(previousValue)))
+		case !reflect.DeepEqual(previousValue.Interface(), nextValue.Interface()):
+			diffs = append(diffs, fmt.Sprintf("%v: %v -> %v", key, formatConfig(previousValue), formatConfig(nextValue)))
+		}
+	}
+	return diffs
+}
+
+// formatConfig describes the value like "{host:localhost port:8080}" without secrets.
+func formatConfig(value reflect.Value) string {
+	switch value.Kind() {
+	case reflect.Struct:
+		fields := make([]string, 0, value.NumField())
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			formatted := formatConfig(value.Field(i))
+			if secretConfigFields[field.Name] && !value.Field(i).IsZero() {
+				formatted = redactedConfigValue
+			}
+			fields = append(fields, fmt.Sprintf("%v:%v", configKey(field), formatted))
+		}
+		return "{" + strings.Join(fields, " ") + "}"
+	case reflect.Slice:
+		if value.Type().Elem().Kind() == reflect.Struct {
+			elements := make([]string, 0, value.Len())
+			for i := 0; i < value.Len(); i++ {
+				elements = append(elements, formatConfig(value.Index(i)))
+			}
+			return "[" + strings.Join(elements, " ") + "]"
+		}
+	}
+	return fmt.Sprintf("%+v", value.Interface())
+}
+
+// String describes the configuration for logs.
+// Values of secretConfigFields are redacted.
+func (c Config) String() string {
+	return formatConfig(reflect.ValueOf(c))
+}
+
+// diffConfigs returns descriptions of changed values between configurations.
+func diffConfigs(previous, next *Config) []string {
+	return diffConfig("", reflect.ValueOf(*previous), reflect.ValueOf(*next))
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfigStringRedactsSecrets(t *testing.T) {
+	config := Config{
+		Port:                         8080,
+		GoogleApplicationCredentials: "/secrets/service-account.json",
+		ServiceAccounts: []ServiceAccountConfig{
+			{Alias: "deployer", GoogleApplicationCredentials: "/secrets/deployer.json"},
+		},
+		Admin: AdminConfig{Port: 8081, Token: "admin-secret-token"},
+		Fake:  FakeConfig{KeyFile: "/secrets/fake-key.pem"},
+	}
+	formatted := config.String()
+	for _, secret := range []string{
+		"/secrets/service-account.json",
+		"/secrets/deployer.json",
+		"admin-secret-token",
+		"/secrets/fake-key.pem",
+	} {
+		if strings.Contains(formatted, secret) {
+			t.Errorf("%q is not redacted: %v", secret, formatted)
+		}
+	}
+	for _, expected := range []string{
+		"port:8080",
+		"token:" + redactedConfigValue,
+		"alias:deployer",
+		// Empty values are not redacted to tell they're not configured.
+		"cloudsdk-config: ",
+	} {
+		if !strings.Contains(formatted, expected) {
+			t.Errorf("%q is not in %v", expected, formatted)
+		}
+	}
+}
+
+func TestDiffConfigsRedactsSecrets(t *testing.T) {
+	previous := &Config{Admin: AdminConfig{Token: "previous-secret"}}
+	next := &Config{Admin: AdminConfig{Token: "next-secret"}, Port: 8080}
+	expected := []string{
+		"port: 0 -> 8080",
+		"admin.token: (changed)",
+	}
+	if diffs := diffConfigs(previous, next); !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("expected %v but got %v", expected, diffs)
+	}
+}
+
+func TestDiffConfigsRedactsSecretsOfServiceAccounts(t *testing.T) {
+	deployer := ServiceAccountConfig{Alias: "deployer", GoogleApplicationCredentials: "/secrets/deployer.json"}
+	builder := ServiceAccountConfig{Alias: "builder", GoogleApplicationCredentials: "/secrets/builder.json"}
+	for _, tt := range []struct {
+		name     string
+		previous []ServiceAccountConfig
+		next     []ServiceAccountConfig
+	}{
+		{"added", []ServiceAccountConfig{deployer}, []ServiceAccountConfig{deployer, builder}},
+		{"removed", []ServiceAccountConfig{deployer, builder}, []ServiceAccountConfig{deployer}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			diffs := diffConfigs(&Config{ServiceAccounts: tt.previous}, &Config{ServiceAccounts: tt.next})
+			if len(diffs) != 1 {
+				t.Fatalf("expected a change but got %v", diffs)
+			}
+			for _, secret := range []string{"/secrets/deployer.json", "/secrets/builder.json"} {
+				if strings.Contains(diffs[0], secret) {
+					t.Errorf("%q is not redacted: %v", secret, diffs[0])
+				}
+			}
+			for _, expected := range []string{"service-accounts: ", "alias:builder", "google-application-credentials:" + redactedConfigValue} {
+				if !strings.Contains(diffs[0], expected) {
+					t.Errorf("%q is not in %v", expected, diffs[0])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// credentialsCheckInterval is the minimum interval to check changes of credentials files.
+const credentialsCheckInterval = time.Second
+
+const applicationDefaultCredentialsFile = "application_default_credentials.json"
+
+// wellKnownCredentialsFile returns the file google.FindDefaultCredentials looks up.
+func wellKnownCredentialsFile() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("APPDATA"), "gcloud", applicationDefaultCredentialsFile)
+	}
+	return filepath.Join(os.Getenv("HOME"), ".config", "gcloud", applicationDefaultCredentialsFile)
+}
+
+const (
+	credentialsSourceFake           = "fake"
+	credentialsSourceMetadataServer = "metadata server"
+)
+
+// defaultCredentialsSource returns where google.FindDefaultCredentials loads credentials from.
+func defaultCredentialsSource() string {
+	if env := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); env != "" {
+		return env
+	}
+	if file := wellKnownCredentialsFile(); fileExists(file) {
+		return file
+	}
+	return credentialsSourceMetadataServer
+}
+
+func fileExists(file string) bool {
+	stat, err := os.Stat(file)
+	return err == nil && !stat.IsDir()
+}
+
+// credentialsFiles returns files credentials may be loaded from.
+func (a *serviceAccount) credentialsFiles() []string {
+	if a.fake != nil {
+		return nil
+	}
+	var files []string
+	if a.config.GoogleApplicationCredentials != "" {
+		files = append(files, a.config.GoogleApplicationCredentials)
+	}
+	cloudSDKConfig := a.config.CloudSDKConfig
+	if cloudSDKConfig == "" {
+		cloudSDKConfig = os.Getenv("CLOUDSDK_CONFIG")
+	}
+	if cloudSDKConfig != "" {
+		files = append(files, filepath.Join(cloudSDKConfig, applicationDefaultCredentialsFile))
+	}
+	if env := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); env != "" {
+		files = append(files, env)
+	}
+	return append(files, wellKnownCredentialsFile())
+}
+
+// credentialsStamp returns a string changing when any of files is changed.
+func credentialsStamp(files []string) string {
+	stamps := make([]string, 0, len(files))
+	for _, file := range files {
+		stat, err := os.Stat(file)
+		if err != nil {
+			stamps = append(stamps, fmt.Sprintf("%v:-", file))
+			continue
+		}
+		stamps = append(stamps, fmt.Sprintf("%v:%v:%v", file, stat.ModTime().UnixNano(), stat.Size()))
+	}
+	return strings.Join(stamps, "\n")
+}
+
+// cachedIfUnchanged returns the cached credentials if credentials files are not changed since loaded.
+// Files are checked at most once in credentialsCheckInterval.
+func (a *serviceAccount) cachedIfUnchanged() *cachedDefaultCredentials {
+	a.mutex.Lock()
+	cache, stamp, checkedAt := a.cache, a.stamp, a.checkedAt
+	a.mutex.Unlock()
+	if cache == nil {
+		return nil
+	}
+	if time.Since(checkedAt) < credentialsCheckInterval {
+		return cache
+	}
+	if credentialsStamp(a.credentialsFiles()) != stamp {
+		return nil
+	}
+	a.mutex.Lock()
+	a.checkedAt = time.Now()
+	a.mutex.Unlock()
+	return cache
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/ikedam/gtokenserver/internal/util"
+	"github.com/ikedam/gtokenserver/log"
+	"golang.org/x/oauth2/google"
+)
+
+// FakeConfig is a configuration of the fake mode.
+// In the fake mode, tokens are issued locally and Google is never accessed.
+type FakeConfig struct {
+	Enabled bool
+	// Email is the email of the service account without service-accounts.
+	// Defaults to gtokenserver@<project>.iam.gserviceaccount.com
+	Email string
+	// NumericProjectID defaults to a number computed from the project ID.
+	NumericProjectID int64 `mapstructure:"numeric-project-id"`
+	// KeyFile is a PEM file of the RSA private key to sign ID tokens.
+	// A key is generated at startup if not specified.
+	KeyFile string `mapstructure:"key-file"`
+	// Issuer is the iss claim of ID tokens and the issuer in the OpenID configuration.
+	// jwks_uri in the OpenID configuration is resolved against it.
+	// Defaults to the URL of the server like http://localhost:8080.
+	Issuer string
+}
+
+const (
+	fakeDefaultProject = "fake-project"
+	fakeKeyBits        = 2048
+
+	// fakeJWKSPath is the same path to Google's
+	fakeJWKSPath             = "/oauth2/v3/certs"
+	fakeOpenIDConfigPath     = "/.well-known/openid-configuration"
+	fakeServiceAccountDomain = "iam.gserviceaccount.com"
+)
+
+// newFakeCredentials is replaced in tests to simulate slow credentials.
+var newFakeCredentials = util.NewFakeCredentials
+
+// fakeIssuer issues fake credentials
+type fakeIssuer struct {
+	project          string
+	numericProjectID int64
+	issuer           string
+	jwksURI          string
+	key              *rsa.PrivateKey
+	// generated is true if key is not loaded from a file
+	generated bool
+}
+
+// newFakeIssuer returns nil if the fake mode is disabled.
+// The key generated for previous is kept to verify ID tokens issued before reloads.
+func newFakeIssuer(config *Config, previous *fakeIssuer) (*fakeIssuer, error) {
+	if !config.Fake.Enabled {
+		return nil, nil
+	}
+	project := config.Project
+	if project == "" {
+		project = fakeDefaultProject
+	}
+	numericProjectID := config.Fake.NumericProjectID
+	if numericProjectID == 0 {
+		h := fnv.New64a()
+		h.Write([]byte(project))
+		// Project numbers are 12 digits.
+		numericProjectID = int64(h.Sum64()%900000000000) + 100000000000
+	}
+	issuer := config.Fake.Issuer
+	if issuer == "" {
+		issuer = defaultFakeIssuer(config)
+	}
+	issuerURL, err := url.Parse(issuer)
+	if err != nil || issuerURL.Scheme == "" || issuerURL.Host == "" {
+		return nil, fmt.Errorf("invalid fake.issuer %v: must be a URL like https://example.com", issuer)
+	}
+	var key *rsa.PrivateKey
+	if config.Fake.KeyFile != "" {
+		key, err = loadFakeKey(config.Fake.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+	} else if previous != nil && previous.generated {
+		key = previous.key
+	} else {
+		key, err = rsa.GenerateKey(rand.Reader, fakeKeyBits)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate a key: %w", err)
+		}
+	}
+	log.WithField("project", project).
+		WithField("issuer", issuer).
+		WithField("kid", util.PublicKeyID(&key.PublicKey)).
+		Warning("Running in the fake mode: tokens are not valid for Google APIs")
+	return &fakeIssuer{
+		project:          project,
+		numericProjectID: numericProjectID,
+		issuer:           issuer,
+		jwksURI:          issuerURL.ResolveReference(&url.URL{Path: fakeJWKSPath}).String(),
+		key:              key,
+		generated:        config.Fake.KeyFile == "",
+	}, nil
+}
+
+// defaultFakeIssuer returns the URL of the server.
+// It's the first TCP address in listen, or host and port.
+// Unspecified hosts like 0.0.0.0 are replaced with localhost.
+func defaultFakeIssuer(config *Config) string {
+	hostport := net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+	for _, address := range config.Listen {
+		if u, err := url.Parse(address); err == nil && u.Scheme == listenSchemeTCP && u.Host != "" {
+			hostport = u.Host
+			break
+		}
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return "http://" + hostport
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+func loadFakeKey(file string) (*rsa.PrivateKey, error) {
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from %v: %w", file, err)
+	}
+	block, _ := pem.Decode(body)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %v", file)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the key in %v: %w", file, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not a RSA private key: %v", file)
+	}
+	return key, nil
+}
+
+// defaultEmail returns the email for the service account name.
+func (f *fakeIssuer) defaultEmail(name string) string {
+	return fmt.Sprintf("%v@%v.%v", name, f.project, fakeServiceAccountDomain)
+}
+
+func (f *fakeIssuer) credentials(email string, scopes ...string) (*google.Credentials, error) {
+	return newFakeCredentials(email, f.project, f.issuer, f.key, scopes...)
+}
+
+type openIDConfiguration struct {
+	Issuer                           string   `json:"issuer"`
+	JWKSURI                          string   `json:"jwks_uri"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+}
+
+func (s *Server) handleFakeJWKS(w http.ResponseWriter, r *http.Request) {
+	s.writeJSONResponse(w, util.NewJSONWebKeySet(&s.fake.key.PublicKey))
+}
+
+// handleFakeOpenIDConfiguration allows OpenID Connect libraries to discover the JWKS.
+func (s *Server) handleFakeOpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	s.writeJSONResponse(w, &openIDConfiguration{
+		Issuer:                           s.fake.issuer,
+		JWKSURI:                          s.fake.jwksURI,
+		IDTokenSigningAlgValuesSupported: []string{"RS256"},
+	})
+}
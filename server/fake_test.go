@@ -0,0 +1,48 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestFakeOpenIDConfiguration(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		config  *Config
+		issuer  string
+		jwksURI string
+	}{
+		{
+			name:    "default",
+			config:  &Config{Host: "0.0.0.0", Port: 8080},
+			issuer:  "http://localhost:8080",
+			jwksURI: "http://localhost:8080/oauth2/v3/certs",
+		},
+		{
+			name:    "configured",
+			config:  &Config{Fake: FakeConfig{Issuer: "https://tokens.example.com"}},
+			issuer:  "https://tokens.example.com",
+			jwksURI: "https://tokens.example.com/oauth2/v3/certs",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newFakeTestServer(t, tt.config)
+			rsp, err := http.Get(ts.URL + fakeOpenIDConfigPath)
+			if err != nil {
+				t.Fatalf("failed to request: %v", err)
+			}
+			defer rsp.Body.Close()
+			var config openIDConfiguration
+			if err := json.NewDecoder(rsp.Body).Decode(&config); err != nil {
+				t.Fatalf("failed to parse the response: %v", err)
+			}
+			if config.Issuer != tt.issuer {
+				t.Errorf("expected issuer %v but got %v", tt.issuer, config.Issuer)
+			}
+			if config.JWKSURI != tt.jwksURI {
+				t.Errorf("expected jwks_uri %v but got %v", tt.jwksURI, config.JWKSURI)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ikedam/gtokenserver/log"
+)
+
+// InstanceConfig is a configuration of the emulated instance
+type InstanceConfig struct {
+	// ID is the numeric ID of the instance.
+	// Defaults to a number generated from the name.
+	ID string
+	// Name defaults to the hostname of the machine running gtokenserver
+	Name string
+	// Hostname defaults to the internal DNS name of the instance
+	Hostname string
+	// Zone is the name of the zone like "us-central1-a"
+	Zone string
+	// MachineType is the name of the machine type like "e2-medium"
+	MachineType string `mapstructure:"machine-type"`
+	// IP is the internal IP address of the instance. Defaults to the address of each client.
+	IP string
+	// Network is the name of the VPC network
+	Network string
+	// Attributes are custom metadata of the instance.
+	Attributes Attributes
+}
+
+const (
+	defaultInstanceZone        = "us-central1-a"
+	defaultInstanceMachineType = "e2-medium"
+	defaultInstanceNetwork     = "default"
+	defaultInstanceName        = "gtokenserver"
+)
+
+func (s *Server) instanceName(r *http.Request) (string, error) {
+	if s.config.Instance.Name != "" {
+		return s.config.Instance.Name, nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return defaultInstanceName, nil
+	}
+	// Instance names are not FQDN.
+	return strings.SplitN(hostname, ".", 2)[0], nil
+}
+
+func (s *Server) instanceID(r *http.Request) (interface{}, error) {
+	if s.config.Instance.ID != "" {
+		// IDs are numbers in JSON outputs.
+		if id, err := strconv.ParseUint(s.config.Instance.ID, 10, 64); err == nil {
+			return id, nil
+		}
+		return s.config.Instance.ID, nil
+	}
+	name, err := s.instanceName(r)
+	if err != nil {
+		return nil, err
+	}
+	// Generate a stable ID looking like ones of Compute Engine.
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return h.Sum64() >> 1, nil
+}
+
+func (s *Server) instanceZoneName() string {
+	if s.config.Instance.Zone != "" {
+		return s.config.Instance.Zone
+	}
+	return defaultInstanceZone
+}
+
+// projectNumberForResources returns the project number to build resource names.
+// It falls back to the project ID, which Google APIs also accept in resource names,
+// when the project number is not available.
+func (s *Server) projectNumberForResources(r *http.Request) (string, error) {
+	if s.config.ProjectNumber != 0 {
+		return fmt.Sprintf("%v", s.config.ProjectNumber), nil
+	}
+	cred := s.getCredentials(r.Context())
+	if cred == nil {
+		return "0", nil
+	}
+	numericProjectID, err := cred.GetNumericProjectID(r.Context())
+	if err != nil {
+		log.FromContext(r.Context()).
+			WithError(err).
+			Warning("Could not retrieve the project number: using the project ID instead. Configure project-number to avoid this")
+		return cred.ProjectID, nil
+	}
+	return fmt.Sprintf("%v", numericProjectID), nil
+}
+
+func (s *Server) instanceZone(r *http.Request) (string, error) {
+	projectNumber, err := s.projectNumberForResources(r)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("projects/%v/zones/%v", projectNumber, s.instanceZoneName()), nil
+}
+
+func (s *Server) instanceMachineType(r *http.Request) (string, error) {
+	projectNumber, err := s.projectNumberForResources(r)
+	if err != nil {
+		return "", err
+	}
+	machineType := s.config.Instance.MachineType
+	if machineType == "" {
+		machineType = defaultInstanceMachineType
+	}
+	return fmt.Sprintf("projects/%v/machineTypes/%v", projectNumber, machineType), nil
+}
+
+func (s *Server) instanceHostname(r *http.Request) (string, error) {
+	if s.config.Instance.Hostname != "" {
+		return s.config.Instance.Hostname, nil
+	}
+	name, err := s.instanceName(r)
+	if err != nil {
+		return "", err
+	}
+	projectID := ""
+	if cred := s.getCredentials(r.Context()); cred != nil {
+		projectID = cred.ProjectID
+	}
+	if projectID == "" {
+		return name, nil
+	}
+	// Zonal DNS name: https://cloud.google.com/compute/docs/internal-dns
+	return fmt.Sprintf("%v.%v.c.%v.internal", name, s.instanceZoneName(), projectID), nil
+}
+
+func (s *Server) instanceIP(r *http.Request) (string, error) {
+	if s.config.Instance.IP != "" {
+		return s.config.Instance.IP, nil
+	}
+	if isUnixSocketRequest(r) {
+		// Clients of Unix sockets run on the same host.
+		return "127.0.0.1", nil
+	}
+	// Clients run on the emulated instance.
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr, nil
+	}
+	return host, nil
+}
+
+func (s *Server) instanceNetwork(r *http.Request) (string, error) {
+	projectNumber, err := s.projectNumberForResources(r)
+	if err != nil {
+		return "", err
+	}
+	network := s.config.Instance.Network
+	if network == "" {
+		network = defaultInstanceNetwork
+	}
+	return fmt.Sprintf("projects/%v/networks/%v", projectNumber, network), nil
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/ikedam/gtokenserver/log"
+)
+
+// LinkLocalConfig is a configuration to serve on the address of Google metadata servers.
+// It requires Linux and privileges to configure network interfaces (CAP_NET_ADMIN).
+type LinkLocalConfig struct {
+	Enabled bool
+	// Interface is the dummy interface to add the address to. Defaults to gtokenserver0.
+	// It's created if not exist, and deleted on shutdown.
+	Interface string
+	// Address defaults to 169.254.169.254.
+	Address string
+	// Port defaults to 80.
+	Port int
+	// HostsFile is the hosts file (e.g. /etc/hosts) to add metadata.google.internal to.
+	// The entry is removed on shutdown if added by gtokenserver.
+	HostsFile string `mapstructure:"hosts-file"`
+}
+
+const (
+	defaultLinkLocalInterface = "gtokenserver0"
+	defaultLinkLocalAddress   = "169.254.169.254"
+	defaultLinkLocalPort      = 80
+
+	metadataHostname      = "metadata.google.internal"
+	metadataShortHostname = "metadata"
+)
+
+// linkLocal configures the address of Google metadata servers
+type linkLocal struct {
+	config LinkLocalConfig
+	// createdInterface is true if the interface is created by gtokenserver
+	createdInterface bool
+	addedAddress     bool
+	hostsEntry       string
+	addedHostsEntry  bool
+}
+
+func newLinkLocal(config LinkLocalConfig) *linkLocal {
+	if config.Interface == "" {
+		config.Interface = defaultLinkLocalInterface
+	}
+	if config.Address == "" {
+		config.Address = defaultLinkLocalAddress
+	}
+	if config.Port == 0 {
+		config.Port = defaultLinkLocalPort
+	}
+	return &linkLocal{
+		config: config,
+		hostsEntry: fmt.Sprintf(
+			"%v\t%v %v # added by gtokenserver",
+			config.Address,
+			metadataHostname,
+			metadataShortHostname,
+		),
+	}
+}
+
+func (c *LinkLocalConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("link-local is supported only on Linux")
+	}
+	if c.Address != "" && net.ParseIP(c.Address) == nil {
+		return fmt.Errorf("invalid address for link-local: %v", c.Address)
+	}
+	return nil
+}
+
+// listenLinkLocal configures the address and listens on it.
+// It returns nil if link-local is disabled.
+// Call cleanup of the returned linkLocal after the listener is closed.
+func (s *Server) listenLinkLocal() (net.Listener, *linkLocal, error) {
+	if !s.config.LinkLocal.Enabled {
+		return nil, nil, nil
+	}
+	l := newLinkLocal(s.config.LinkLocal)
+	if err := l.setup(); err != nil {
+		l.cleanup()
+		return nil, nil, err
+	}
+	hostport := net.JoinHostPort(l.config.Address, fmt.Sprint(l.config.Port))
+	listener, err := net.Listen("tcp", hostport)
+	if err != nil {
+		l.cleanup()
+		return nil, nil, fmt.Errorf("failed to listen %v: %w", hostport, err)
+	}
+	return listener, l, nil
+}
+
+func (l *linkLocal) setup() error {
+	if _, err := runIP("link", "show", "dev", l.config.Interface); err != nil {
+		if _, err := runIP("link", "add", l.config.Interface, "type", "dummy"); err != nil {
+			return err
+		}
+		l.createdInterface = true
+	}
+	addresses, err := runIP("-o", "addr", "show", "dev", l.config.Interface)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(addresses, " "+l.config.Address+"/") {
+		if _, err := runIP("addr", "add", l.config.Address+"/32", "dev", l.config.Interface); err != nil {
+			return err
+		}
+		l.addedAddress = true
+	}
+	if _, err := runIP("link", "set", l.config.Interface, "up"); err != nil {
+		return err
+	}
+	log.WithField("interface", l.config.Interface).
+		WithField("address", l.config.Address).
+		Info("Configured the address of the metadata server")
+
+	if l.config.HostsFile == "" {
+		log.WithField("entry", l.hostsEntry).
+			Info("Add the entry to /etc/hosts to resolve " + metadataHostname)
+		return nil
+	}
+	return l.addHostsEntry()
+}
+
+// cleanup reverts changes by setup.
+// Errors are only logged not to prevent other cleanups.
+func (l *linkLocal) cleanup() {
+	if l.addedHostsEntry {
+		if err := l.removeHostsEntry(); err != nil {
+			log.WithError(err).
+				WithField("file", l.config.HostsFile).
+				Warning("Failed to remove the entry from the hosts file")
+		}
+	}
+	if l.createdInterface {
+		if _, err := runIP("link", "delete", l.config.Interface); err != nil {
+			log.WithError(err).Warning("Failed to delete the interface")
+		}
+		return
+	}
+	if l.addedAddress {
+		if _, err := runIP("addr", "del", l.config.Address+"/32", "dev", l.config.Interface); err != nil {
+			log.WithError(err).Warning("Failed to delete the address")
+		}
+	}
+}
+
+func (l *linkLocal) addHostsEntry() error {
+	body, err := ioutil.ReadFile(l.config.HostsFile)
+	if err != nil {
+		return fmt.Errorf("failed to read from %v: %w", l.config.HostsFile, err)
+	}
+	for _, line := range strings.Split(string(body), "\n") {
+		if line == l.hostsEntry {
+			return nil
+		}
+	}
+	if len(body) > 0 && !bytes.HasSuffix(body, []byte("\n")) {
+		body = append(body, '\n')
+	}
+	body = append(body, []byte(l.hostsEntry+"\n")...)
+	// Write in place as /etc/hosts may be bind-mounted (e.g. in docker containers).
+	if err := writeFileInPlace(l.config.HostsFile, body); err != nil {
+		return err
+	}
+	l.addedHostsEntry = true
+	log.WithField("file", l.config.HostsFile).
+		WithField("entry", l.hostsEntry).
+		Info("Added the entry to the hosts file")
+	return nil
+}
+
+func (l *linkLocal) removeHostsEntry() error {
+	body, err := ioutil.ReadFile(l.config.HostsFile)
+	if err != nil {
+		return fmt.Errorf("failed to read from %v: %w", l.config.HostsFile, err)
+	}
+	lines := strings.Split(string(body), "\n")
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if line != l.hostsEntry {
+			kept = append(kept, line)
+		}
+	}
+	if len(kept) == len(lines) {
+		return nil
+	}
+	return writeFileInPlace(l.config.HostsFile, []byte(strings.Join(kept, "\n")))
+}
+
+func writeFileInPlace(file string, body []byte) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return fmt.Errorf("failed to stat %v: %w", file, err)
+	}
+	if err := ioutil.WriteFile(file, body, info.Mode()); err != nil {
+		return fmt.Errorf("failed to write to %v: %w", file, err)
+	}
+	return nil
+}
+
+// runIP runs ip command of iproute2.
+func runIP(args ...string) (string, error) {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf(
+			"failed to run ip %v: %w: %v",
+			strings.Join(args, " "),
+			err,
+			strings.TrimSpace(string(out)),
+		)
+	}
+	return string(out), nil
+}
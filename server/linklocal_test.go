@@ -0,0 +1,54 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestHostsEntry(t *testing.T) {
+	entry := newLinkLocal(LinkLocalConfig{Enabled: true}).hostsEntry
+	for _, tt := range []struct {
+		name     string
+		hosts    string
+		added    string
+		expected string
+	}{
+		{
+			name:     "added",
+			hosts:    "127.0.0.1\tlocalhost",
+			added:    "127.0.0.1\tlocalhost\n" + entry + "\n",
+			expected: "127.0.0.1\tlocalhost\n",
+		},
+		{
+			name:     "existing",
+			hosts:    "127.0.0.1\tlocalhost\n" + entry + "\n",
+			added:    "127.0.0.1\tlocalhost\n" + entry + "\n",
+			expected: "127.0.0.1\tlocalhost\n" + entry + "\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			file, err := ioutil.TempFile("", "hosts")
+			if err != nil {
+				t.Fatalf("failed to create a temporary file: %v", err)
+			}
+			defer os.Remove(file.Name())
+			file.Close()
+			if err := ioutil.WriteFile(file.Name(), []byte(tt.hosts), 0644); err != nil {
+				t.Fatalf("failed to write to %v: %v", file.Name(), err)
+			}
+
+			l := newLinkLocal(LinkLocalConfig{Enabled: true, HostsFile: file.Name()})
+			if err := l.addHostsEntry(); err != nil {
+				t.Fatalf("failed to add the entry: %v", err)
+			}
+			if body, _ := ioutil.ReadFile(file.Name()); string(body) != tt.added {
+				t.Errorf("expected %q after added but got %q", tt.added, body)
+			}
+			l.cleanup()
+			if body, _ := ioutil.ReadFile(file.Name()); string(body) != tt.expected {
+				t.Errorf("expected %q after cleanup but got %q", tt.expected, body)
+			}
+		})
+	}
+}
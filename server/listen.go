@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/ikedam/gtokenserver/internal/util"
+	"github.com/ikedam/gtokenserver/log"
+)
+
+const (
+	listenSchemeTCP  = "tcp"
+	listenSchemeUnix = "unix"
+)
+
+// listen returns listeners for the server.
+// Sockets passed with systemd socket activation are used in addition to listen.
+// host and port are used only if neither is available.
+func (s *Server) listen() ([]net.Listener, error) {
+	listeners, err := util.SystemdListeners()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range listeners {
+		log.WithField("address", l.Addr().String()).Debug("Using the socket passed by systemd")
+	}
+	for _, address := range s.config.Listen {
+		l, err := listenURL(address)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) > 0 {
+		return listeners, nil
+	}
+	hostport := fmt.Sprintf("%v:%v", s.config.Host, s.config.Port)
+	l, err := net.Listen("tcp", hostport)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen %v: %w", hostport, err)
+	}
+	return []net.Listener{l}, nil
+}
+
+// listenURL listens an address like tcp://127.0.0.1:8080 or unix:///run/gtokenserver.sock.
+// The permission of Unix sockets can be specified like unix:///run/gtokenserver.sock?mode=0660 .
+func listenURL(address string) (net.Listener, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address to listen: %v: %w", address, err)
+	}
+	switch u.Scheme {
+	case listenSchemeTCP:
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid address to listen: %v: no host and port", address)
+		}
+		l, err := net.Listen("tcp", u.Host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen %v: %w", address, err)
+		}
+		return l, nil
+	case listenSchemeUnix:
+		return listenUnix(address, u)
+	}
+	return nil, fmt.Errorf("invalid address to listen: %v: scheme must be tcp or unix", address)
+}
+
+func listenUnix(address string, u *url.URL) (net.Listener, error) {
+	// unix://relative/path is also accepted.
+	path := u.Host + u.Path
+	if path == "" {
+		return nil, fmt.Errorf("invalid address to listen: %v: no path", address)
+	}
+	var mode os.FileMode
+	if m := u.Query().Get("mode"); m != "" {
+		parsed, err := strconv.ParseUint(m, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mode for %v: %w", address, err)
+		}
+		mode = os.FileMode(parsed)
+	}
+	// Remove the socket left by the previous process.
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove the old socket %v: %w", path, err)
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen %v: %w", address, err)
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to change the mode of %v: %w", path, err)
+		}
+	}
+	return l, nil
+}
+
+// isUnixSocketRequest returns true if the request is received from a Unix socket.
+func isUnixSocketRequest(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == listenSchemeUnix
+}
@@ -0,0 +1,382 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ikedam/gtokenserver/log"
+)
+
+// metadataNode is a node of the metadata tree.
+// It's one of *metadataDirectory, metadataLazyDirectory, metadataValue or metadataEndpoint.
+type metadataNode interface{}
+
+// metadataDirectory is a directory in the metadata tree
+type metadataDirectory struct {
+	entries []*metadataEntry
+	// custom means names of entries are user-defined (e.g. attributes):
+	// they are not converted to camelCase in JSON outputs,
+	// and accesses to missing entries are not reported as unimplemented.
+	custom bool
+	// list means the directory is serialized as an array in JSON outputs.
+	list bool
+}
+
+// metadataLazyDirectory is a directory built only when it's accessed
+type metadataLazyDirectory func() (*metadataDirectory, error)
+
+// metadataValue is a leaf value resolved only when it's accessed.
+// The value should be a string, an integer or a slice of strings.
+type metadataValue func() (interface{}, error)
+
+// metadataEndpoint is a leaf served by a dedicated handler (e.g. token).
+// It's listed in the directory but not included in recursive outputs.
+type metadataEndpoint struct{}
+
+type metadataEntry struct {
+	name string
+	node metadataNode
+	// hidden entries are accessible but neither listed nor included in recursive outputs.
+	hidden bool
+}
+
+func newMetadataDirectory(entries ...*metadataEntry) *metadataDirectory {
+	return &metadataDirectory{
+		entries: entries,
+	}
+}
+
+func metadataEntryOf(name string, node metadataNode) *metadataEntry {
+	return &metadataEntry{
+		name: name,
+		node: node,
+	}
+}
+
+// constantValue returns a metadataValue returning the fixed value.
+func constantValue(value interface{}) metadataValue {
+	return func() (interface{}, error) {
+		return value, nil
+	}
+}
+
+func (d *metadataDirectory) lookup(name string) metadataNode {
+	for _, entry := range d.entries {
+		if entry.name == name {
+			return entry.node
+		}
+	}
+	return nil
+}
+
+func (d *metadataDirectory) visibleEntries() []*metadataEntry {
+	entries := make([]*metadataEntry, 0, len(d.entries))
+	for _, entry := range d.entries {
+		if !entry.hidden {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func isMetadataDirectory(node metadataNode) bool {
+	switch node.(type) {
+	case *metadataDirectory, metadataLazyDirectory:
+		return true
+	}
+	return false
+}
+
+// resolveMetadataDirectory returns the directory for the node.
+// It returns nil if the node is not a directory.
+func resolveMetadataDirectory(node metadataNode) (*metadataDirectory, error) {
+	switch n := node.(type) {
+	case *metadataDirectory:
+		return n, nil
+	case metadataLazyDirectory:
+		return n()
+	}
+	return nil, nil
+}
+
+// listMetadataDirectory returns names of entries. Names of directories end with "/".
+func listMetadataDirectory(dir *metadataDirectory) []string {
+	names := []string{}
+	for _, entry := range dir.visibleEntries() {
+		if isMetadataDirectory(entry.node) {
+			names = append(names, entry.name+"/")
+		} else {
+			names = append(names, entry.name)
+		}
+	}
+	return names
+}
+
+// toCamelCase converts names in the metadata server to keys in JSON outputs:
+// e.g. "numeric-project-id" to "numericProjectId".
+func toCamelCase(name string) string {
+	parts := strings.Split(name, "-")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// metadataToJSON returns the object to serialize the node recursively in JSON.
+func metadataToJSON(node metadataNode) (interface{}, error) {
+	if value, ok := node.(metadataValue); ok {
+		return value()
+	}
+	dir, err := resolveMetadataDirectory(node)
+	if err != nil {
+		return nil, err
+	}
+	if dir == nil {
+		return nil, fmt.Errorf("unexpected node: %T", node)
+	}
+	if dir.list {
+		values := []interface{}{}
+		for _, entry := range dir.visibleEntries() {
+			if _, ok := entry.node.(metadataEndpoint); ok {
+				continue
+			}
+			value, err := metadataToJSON(entry.node)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+	values := make(map[string]interface{})
+	for _, entry := range dir.visibleEntries() {
+		if _, ok := entry.node.(metadataEndpoint); ok {
+			continue
+		}
+		value, err := metadataToJSON(entry.node)
+		if err != nil {
+			return nil, err
+		}
+		key := entry.name
+		if !dir.custom {
+			key = toCamelCase(key)
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// formatMetadataValue formats the leaf value as a text.
+func formatMetadataValue(value interface{}) string {
+	switch v := value.(type) {
+	case []string:
+		var b strings.Builder
+		for _, line := range v {
+			b.WriteString(line)
+			b.WriteString("\n")
+		}
+		return b.String()
+	}
+	return fmt.Sprint(value)
+}
+
+// writeMetadataText writes the node recursively as lines of "path value".
+func writeMetadataText(b *strings.Builder, prefix string, node metadataNode) error {
+	if value, ok := node.(metadataValue); ok {
+		v, err := value()
+		if err != nil {
+			return err
+		}
+		if lines, ok := v.([]string); ok {
+			for i, line := range lines {
+				fmt.Fprintf(b, "%v/%v %v\n", prefix, i, line)
+			}
+			return nil
+		}
+		fmt.Fprintf(b, "%v %v\n", prefix, v)
+		return nil
+	}
+	dir, err := resolveMetadataDirectory(node)
+	if err != nil {
+		return err
+	}
+	if dir == nil {
+		return nil
+	}
+	for _, entry := range dir.visibleEntries() {
+		path := entry.name
+		if prefix != "" {
+			path = prefix + "/" + entry.name
+		}
+		if err := writeMetadataText(b, path, entry.node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderMetadata renders the node for the request.
+// It returns the body and the content type.
+func renderMetadata(node metadataNode, recursive bool, alt string) (string, string, error) {
+	if value, ok := node.(metadataValue); ok {
+		v, err := value()
+		if err != nil {
+			return "", "", err
+		}
+		if alt == "json" {
+			body, err := json.Marshal(v)
+			if err != nil {
+				return "", "", err
+			}
+			return string(body), "application/json", nil
+		}
+		return formatMetadataValue(v), "application/text", nil
+	}
+
+	dir, err := resolveMetadataDirectory(node)
+	if err != nil {
+		return "", "", err
+	}
+	if !recursive {
+		names := listMetadataDirectory(dir)
+		if alt == "json" {
+			body, err := json.Marshal(names)
+			if err != nil {
+				return "", "", err
+			}
+			return string(body), "application/json", nil
+		}
+		return formatMetadataValue(names), "application/text", nil
+	}
+	// Recursive outputs default to JSON.
+	if alt == "text" {
+		var b strings.Builder
+		if err := writeMetadataText(&b, "", dir); err != nil {
+			return "", "", err
+		}
+		return b.String(), "application/text", nil
+	}
+	value, err := metadataToJSON(dir)
+	if err != nil {
+		return "", "", err
+	}
+	body, err := json.Marshal(value)
+	if err != nil {
+		return "", "", err
+	}
+	return string(body), "application/json", nil
+}
+
+const metadataRoot = "/computeMetadata/v1"
+
+// lookupMetadata returns the node at the path in the tree.
+// It returns nil if the node doesn't exist, with unimplemented true
+// if the path is not implemented in gtokenserver (not just missing like attributes).
+func lookupMetadata(tree *metadataDirectory, path string) (node metadataNode, unimplemented bool, err error) {
+	node = tree
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		dir, err := resolveMetadataDirectory(node)
+		if err != nil {
+			return nil, false, err
+		}
+		if dir == nil {
+			return nil, false, nil
+		}
+		node = dir.lookup(name)
+		if node == nil {
+			return nil, !dir.custom, nil
+		}
+	}
+	if _, ok := node.(metadataEndpoint); ok {
+		return nil, true, nil
+	}
+	return node, false, nil
+}
+
+// handleMetadata serves paths in the metadata tree.
+func (s *Server) handleMetadata(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	alt := query.Get("alt")
+	switch alt {
+	case "", "json", "text":
+	default:
+		s.writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid alt: %v", alt))
+		return
+	}
+	recursive := query.Get("recursive") == "true"
+	wait, err := parseWaitForChange(query)
+	if err != nil {
+		s.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, metadataRoot)
+	node, unimplemented, err := lookupMetadata(s.buildMetadataTree(r), path)
+	if err != nil {
+		log.FromContext(r.Context()).
+			WithError(err).
+			WithField("path", r.URL.Path).
+			Error("Could not resolve the metadata")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if node == nil {
+		if unimplemented {
+			s.notFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	isDir := isMetadataDirectory(node)
+	if isDir && !strings.HasSuffix(path, "/") {
+		// Directories are accessible only with trailing slashes
+		// like the actual metadata server.
+		u := *r.URL
+		u.Path = r.URL.Path + "/"
+		w.Header().Add("Metadata-Flavor", "Google")
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+		return
+	}
+	if !isDir && strings.HasSuffix(path, "/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	body, contentType, err := renderMetadata(node, recursive, alt)
+	if err == nil && wait != nil { // Be careful: not != but ==
+		body, contentType, err = s.waitForChange(r, wait, path, recursive, alt, body, contentType)
+	}
+	if err == errMetadataNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err == errClientDenied {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err != nil && r.Context().Err() != nil {
+		// The client has gone while waiting for changes.
+		return
+	}
+	if err != nil {
+		log.FromContext(r.Context()).
+			WithError(err).
+			WithField("path", r.URL.Path).
+			Error("Could not resolve the metadata")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Metadata-Flavor", "Google")
+	w.Header().Add("Content-Type", contentType)
+	w.Header().Add("ETag", computeETag(body))
+	w.Write([]byte(body))
+}
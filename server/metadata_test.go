@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// testInstanceConfig is the configuration of tests of instance metadata.
+// The project number is configured not to access Google.
+var testInstanceConfig = Config{
+	ProjectNumber: 42,
+	Instance: InstanceConfig{
+		Name:        "vm",
+		Zone:        "asia-northeast1-a",
+		MachineType: "n2-standard-2",
+		Attributes: Attributes{
+			"foo": "bar",
+			"baz": map[string]interface{}{"value": "qux"},
+		},
+	},
+}
+
+func TestInstanceMetadata(t *testing.T) {
+	config := testInstanceConfig
+	ts := newTestServer(t, &config)
+
+	for _, tt := range []struct {
+		path     string
+		expected string
+	}{
+		{"/instance/name", "vm"},
+		{"/instance/zone", "projects/42/zones/asia-northeast1-a"},
+		{"/instance/zone?alt=json", `"projects/42/zones/asia-northeast1-a"`},
+		{"/instance/machine-type", "projects/42/machineTypes/n2-standard-2"},
+		{"/instance/network-interfaces/0/ip", "127.0.0.1"},
+		{"/instance/attributes/", "baz\nfoo\n"},
+		{"/instance/attributes/foo", "bar"},
+		{"/instance/attributes/baz", "qux"},
+		{"/instance/attributes/?recursive=true", `{"baz":"qux","foo":"bar"}`},
+		{"/instance/attributes/?recursive=true&alt=text", "baz qux\nfoo bar\n"},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			code, body := getMetadata(t, ts, tt.path)
+			if code != http.StatusOK {
+				t.Fatalf("expected %v but got %v: %v", http.StatusOK, code, body)
+			}
+			if body != tt.expected {
+				t.Errorf("expected %q but got %q", tt.expected, body)
+			}
+		})
+	}
+}
+
+// TestInstanceMetadataRecursive serves service accounts in the fake mode.
+func TestInstanceMetadataRecursive(t *testing.T) {
+	config := testInstanceConfig
+	ts := newFakeTestServer(t, &config)
+
+	code, body := getMetadata(t, ts, "/instance/?recursive=true")
+	if code != http.StatusOK {
+		t.Fatalf("expected %v but got %v: %v", http.StatusOK, code, body)
+	}
+	var instance struct {
+		Name              string            `json:"name"`
+		Zone              string            `json:"zone"`
+		MachineType       string            `json:"machineType"`
+		Attributes        map[string]string `json:"attributes"`
+		NetworkInterfaces []struct {
+			Network string `json:"network"`
+		} `json:"networkInterfaces"`
+	}
+	if err := json.Unmarshal([]byte(body), &instance); err != nil {
+		t.Fatalf("failed to parse %q: %v", body, err)
+	}
+	if instance.Name != "vm" ||
+		instance.Zone != "projects/42/zones/asia-northeast1-a" ||
+		instance.MachineType != "projects/42/machineTypes/n2-standard-2" ||
+		instance.Attributes["foo"] != "bar" ||
+		len(instance.NetworkInterfaces) != 1 ||
+		instance.NetworkInterfaces[0].Network != "projects/42/networks/default" {
+		t.Errorf("unexpected instance: %v", body)
+	}
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ikedam/gtokenserver/internal/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// MetricsConfig is a configuration of Prometheus metrics
+type MetricsConfig struct {
+	// Enabled serves /metrics without authentication.
+	// /metrics is always served in the admin API.
+	Enabled bool
+}
+
+const (
+	metricsPath      = "/metrics"
+	metricsNamespace = "gtokenserver"
+
+	// routeUnmatched is the route label for requests not matching any routes
+	routeUnmatched = "unmatched"
+
+	// tokenMintRequest is the reason label for tokens issued for requests
+	tokenMintRequest = "request"
+	// tokenMintRefresh is the reason label for tokens refreshed in background
+	tokenMintRefresh = "refresh"
+
+	// scopesLabelConfigured is the scopes label for tokens of scopes configured for service accounts
+	scopesLabelConfigured = "configured"
+	// scopesLabelRequested is the scopes label for tokens of scopes requested with the scopes parameter.
+	// Scopes specified by clients are not labeled as they are to bound the number of series.
+	scopesLabelRequested = "requested"
+
+	upstreamCallEmail         = "email"
+	upstreamCallProjectNumber = "project_number"
+)
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests by route and status code.",
+		},
+		[]string{"route", "code"},
+	)
+	httpRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests by route and status code, including requests waiting for changes.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"route", "code"},
+	)
+	tokenMintsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "token_mints_total",
+			Help:      "Number of access tokens issued by service account, scopes (configured or requested) and reason (request or refresh).",
+		},
+		[]string{"service_account", "scopes", "reason"},
+	)
+	tokenMintFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "token_mint_failures_total",
+			Help:      "Number of failures to issue access tokens by service account, scopes (configured or requested) and reason (request or refresh).",
+		},
+		[]string{"service_account", "scopes", "reason"},
+	)
+	upstreamRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_request_duration_seconds",
+			Help:      "Latency of calls to Google to resolve emails and project numbers.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"call", "result"},
+	)
+	tokenCacheHitsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "token_cache_hits_total",
+			Help:      "Number of requests for requested scopes served with credentials in the token cache.",
+		},
+	)
+	tokenCacheMissesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "token_cache_misses_total",
+			Help:      "Number of requests for requested scopes not found or expired in the token cache.",
+		},
+	)
+	tokenCacheEvictionsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "token_cache_evictions_total",
+			Help:      "Number of credentials evicted from the token cache as it's full.",
+		},
+	)
+	tokenExpiryDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "token_expiry_seconds"),
+		"Seconds until the earliest cached access token expires by service account and scopes (configured or requested).",
+		[]string{"service_account", "scopes"},
+		nil,
+	)
+)
+
+// newMetricsRegistry returns a registry with metrics of the process.
+// Metrics of tokens are collected from the current configuration of running.
+func newMetricsRegistry(running *runningState) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		httpRequestsTotal,
+		httpRequestDuration,
+		tokenMintsTotal,
+		tokenMintFailuresTotal,
+		upstreamRequestDuration,
+		tokenCacheHitsTotal,
+		tokenCacheMissesTotal,
+		tokenCacheEvictionsTotal,
+		&tokenExpiryCollector{running: running},
+	)
+	return registry
+}
+
+func (s *Server) handleMetrics() http.Handler {
+	return promhttp.HandlerFor(s.running.metrics, promhttp.HandlerOpts{})
+}
+
+// instrumentRouter records requests to router by route templates.
+// Spans of requests are also named with route templates.
+func instrumentRouter(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeUnmatched
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.Route != nil {
+			if template, err := match.Route.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		trace.SpanFromContext(r.Context()).SetName(fmt.Sprintf("%v %v", r.Method, route))
+		sniffer := util.NewResponseSniffer(w)
+		start := time.Now()
+		router.ServeHTTP(sniffer, r)
+		labels := prometheus.Labels{"route": route, "code": strconv.Itoa(sniffer.Code())}
+		httpRequestsTotal.With(labels).Inc()
+		httpRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
+
+// observeUpstreamRequest records the latency of a call to Google started at start.
+func observeUpstreamRequest(call string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	upstreamRequestDuration.WithLabelValues(call, result).Observe(time.Since(start).Seconds())
+}
+
+// tokenExpiryCollector collects expiry of tokens cached in the current configuration
+type tokenExpiryCollector struct {
+	running *runningState
+}
+
+func (c *tokenExpiryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tokenExpiryDesc
+}
+
+func (c *tokenExpiryCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.running.get()
+	if s == nil {
+		return
+	}
+	// Tokens for requested scopes share the label, and the earliest expiry is collected.
+	earliest := make(map[[2]string]time.Time)
+	collect := func(cred *cachedDefaultCredentials) {
+		expiry := cred.tokenExpiry()
+		if expiry.IsZero() {
+			return
+		}
+		key := [2]string{cred.account, cred.scopesLabel}
+		if collected, ok := earliest[key]; !ok || expiry.Before(collected) {
+			earliest[key] = expiry
+		}
+	}
+	accounts := make(map[*serviceAccount]bool)
+	for _, account := range s.accounts {
+		accounts[account] = true
+		if cred := account.cachedCredentials(); cred != nil {
+			collect(cred)
+		}
+	}
+	for _, entry := range s.tokens.listEntries() {
+		// The cache may have entries of accounts before reloads.
+		if accounts[entry.key.account] {
+			collect(entry.cred)
+		}
+	}
+	now := time.Now()
+	for key, expiry := range earliest {
+		ch <- prometheus.MustNewConstMetric(
+			tokenExpiryDesc,
+			prometheus.GaugeValue,
+			expiry.Sub(now).Seconds(),
+			key[0],
+			key[1],
+		)
+	}
+}
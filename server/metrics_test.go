@@ -0,0 +1,45 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTokenCacheMetrics(t *testing.T) {
+	counters := map[string]prometheus.Counter{
+		"hits":      tokenCacheHitsTotal,
+		"misses":    tokenCacheMissesTotal,
+		"evictions": tokenCacheEvictionsTotal,
+	}
+	previous := make(map[string]float64)
+	for name, counter := range counters {
+		previous[name] = testutil.ToFloat64(counter)
+	}
+
+	cache := newTokenCache(TokenCacheConfig{Size: 1, TTL: time.Hour})
+	first := tokenCacheKey{scopes: "https://www.googleapis.com/auth/userinfo.email"}
+	second := tokenCacheKey{scopes: "https://www.googleapis.com/auth/cloud-platform"}
+	cache.get(first)
+	cache.add(first, &cachedDefaultCredentials{})
+	cache.get(first)
+	cache.get(first)
+	cache.add(second, &cachedDefaultCredentials{})
+	cache.get(first)
+
+	stats := cache.getStats()
+	for name, expected := range map[string]uint64{
+		"hits":      stats.Hits,
+		"misses":    stats.Misses,
+		"evictions": stats.Evictions,
+	} {
+		if got := testutil.ToFloat64(counters[name]) - previous[name]; got != float64(expected) {
+			t.Errorf("expected %v %v but got %v", expected, name, got)
+		}
+	}
+	if stats.Hits != 2 || stats.Misses != 2 || stats.Evictions != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
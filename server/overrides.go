@@ -0,0 +1,190 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metadataOverride is a change of the metadata tree made at runtime
+type metadataOverride struct {
+	path []string
+	// value is nil for deletion
+	value metadataNode
+	// raw is the value reported to admins
+	raw interface{}
+}
+
+func (o *metadataOverride) hasPrefix(prefix []string) bool {
+	if len(o.path) < len(prefix) {
+		return false
+	}
+	for i, name := range prefix {
+		if o.path[i] != name {
+			return false
+		}
+	}
+	return true
+}
+
+// metadataOverrides holds changes of the metadata tree made at runtime
+type metadataOverrides struct {
+	mutex     sync.RWMutex
+	overrides []*metadataOverride
+}
+
+func newMetadataOverrides() *metadataOverrides {
+	return &metadataOverrides{}
+}
+
+// splitMetadataPath splits the path like "instance/attributes/foo".
+func splitMetadataPath(path string) []string {
+	var names []string
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// set records the change. value is nil for deletion.
+// Overrides of descendants are discarded as they're overwritten.
+func (o *metadataOverrides) set(path []string, value metadataNode, raw interface{}) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	overrides := make([]*metadataOverride, 0, len(o.overrides)+1)
+	for _, override := range o.overrides {
+		if !override.hasPrefix(path) {
+			overrides = append(overrides, override)
+		}
+	}
+	o.overrides = append(overrides, &metadataOverride{
+		path:  path,
+		value: value,
+		raw:   raw,
+	})
+}
+
+// reset discards all changes.
+func (o *metadataOverrides) reset() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.overrides = nil
+}
+
+// list returns changes in the order they are applied.
+func (o *metadataOverrides) list() []*metadataOverride {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	overrides := make([]*metadataOverride, len(o.overrides))
+	copy(overrides, o.overrides)
+	return overrides
+}
+
+// apply returns the tree with changes applied.
+// Lazy directories are kept lazy.
+func (o *metadataOverrides) apply(tree *metadataDirectory) *metadataDirectory {
+	for _, override := range o.list() {
+		tree = overrideMetadataDirectory(tree, override.path, override.value)
+	}
+	return tree
+}
+
+// overrideMetadata returns the node with the value at the path replaced.
+// value is nil for deletion.
+func overrideMetadata(node metadataNode, path []string, value metadataNode) metadataNode {
+	if len(path) == 0 {
+		return value
+	}
+	switch n := node.(type) {
+	case *metadataDirectory:
+		return overrideMetadataDirectory(n, path, value)
+	case metadataLazyDirectory:
+		return metadataLazyDirectory(func() (*metadataDirectory, error) {
+			dir, err := n()
+			if err != nil {
+				return nil, err
+			}
+			return overrideMetadataDirectory(dir, path, value), nil
+		})
+	}
+	if value == nil {
+		// Nothing to delete.
+		return node
+	}
+	// Values are replaced with directories.
+	return overrideMetadataDirectory(&metadataDirectory{custom: true}, path, value)
+}
+
+// overrideMetadataDirectory returns a copy of the directory with the value at the path replaced.
+func overrideMetadataDirectory(dir *metadataDirectory, path []string, value metadataNode) *metadataDirectory {
+	replaced := &metadataDirectory{
+		custom: dir.custom,
+		list:   dir.list,
+	}
+	found := false
+	for _, entry := range dir.entries {
+		if entry.name != path[0] {
+			replaced.entries = append(replaced.entries, entry)
+			continue
+		}
+		found = true
+		node := overrideMetadata(entry.node, path[1:], value)
+		if node == nil {
+			continue
+		}
+		replaced.entries = append(replaced.entries, &metadataEntry{
+			name:   entry.name,
+			node:   node,
+			hidden: entry.hidden,
+		})
+	}
+	if !found && value != nil {
+		replaced.entries = append(replaced.entries, metadataEntryOf(path[0], overrideMetadata(nil, path[1:], value)))
+	}
+	return replaced
+}
+
+// jsonToMetadata converts a value decoded from JSON to a metadata node.
+// Objects are converted to directories.
+func jsonToMetadata(value interface{}) metadataNode {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		dir := &metadataDirectory{
+			custom: true,
+		}
+		for _, name := range names {
+			dir.entries = append(dir.entries, metadataEntryOf(name, jsonToMetadata(v[name])))
+		}
+		return dir
+	case []interface{}:
+		lines := make([]string, 0, len(v))
+		for _, item := range v {
+			line, ok := item.(string)
+			if !ok {
+				break
+			}
+			lines = append(lines, line)
+		}
+		if len(lines) == len(v) {
+			return constantValue(lines)
+		}
+		dir := &metadataDirectory{
+			list: true,
+		}
+		for i, item := range v {
+			dir.entries = append(dir.entries, metadataEntryOf(strconv.Itoa(i), jsonToMetadata(item)))
+		}
+		return dir
+	case nil:
+		return constantValue("")
+	}
+	return constantValue(value)
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ikedam/gtokenserver/log"
+	"golang.org/x/oauth2"
+)
+
+// TokenRefreshConfig is a configuration to refresh tokens in background
+type TokenRefreshConfig struct {
+	// Margin is the duration before expiry to refresh tokens. Defaults to 5m.
+	// Specify a negative value to refresh tokens only when they expire.
+	Margin time.Duration
+	// Idle is the duration since the last use to stop refreshing tokens for requested scopes.
+	// Defaults to 1h. Tokens for configured scopes are always refreshed.
+	Idle time.Duration
+}
+
+const (
+	defaultTokenRefreshMargin = 5 * time.Minute
+	defaultTokenRefreshIdle   = time.Hour
+	// maxTokenRefreshMargin is less than lifetimes of tokens not to refresh them endlessly.
+	maxTokenRefreshMargin = 30 * time.Minute
+
+	tokenRefreshInterval   = time.Second
+	tokenRefreshMinBackoff = time.Second
+	tokenRefreshMaxBackoff = time.Minute
+)
+
+func (c *TokenRefreshConfig) validate() error {
+	if c.Margin >= maxTokenRefreshMargin {
+		return fmt.Errorf("token-refresh.margin must be less than %v", maxTokenRefreshMargin)
+	}
+	return nil
+}
+
+// refreshTokens refreshes tokens before they expire until ctx is done.
+// Tokens of the current configuration are refreshed.
+func (s *Server) refreshTokens(ctx context.Context) {
+	ticker := time.NewTicker(tokenRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.running.get().refreshExpiringTokens()
+	}
+}
+
+func (s *Server) refreshExpiringTokens() {
+	margin := s.config.TokenRefresh.Margin
+	if margin == 0 {
+		margin = defaultTokenRefreshMargin
+	}
+	if margin < 0 {
+		return
+	}
+	idle := s.config.TokenRefresh.Idle
+	if idle == 0 {
+		idle = defaultTokenRefreshIdle
+	}
+	for _, account := range s.accounts {
+		if cred := account.cachedCredentials(); cred != nil && cred.shouldRefresh(margin, 0) {
+			go cred.refreshToken()
+		}
+	}
+	for _, cred := range s.tokens.list() {
+		if cred.shouldRefresh(margin, idle) {
+			go cred.refreshToken()
+		}
+	}
+}
+
+// shouldRefresh returns true if the token expires in margin.
+// The token is not refreshed if not used for idle (0 for no limit).
+// It marks the credentials refreshing when returning true.
+func (c *cachedDefaultCredentials) shouldRefresh(margin time.Duration, idle time.Duration) bool {
+	if c.renew == nil {
+		return false
+	}
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+	now := time.Now()
+	switch {
+	case c.refreshing:
+		return false
+	case c.expiry.IsZero():
+		// No tokens are issued yet.
+		return false
+	case c.expiry.Sub(now) > margin:
+		return false
+	case now.Before(c.nextRefresh):
+		return false
+	case idle > 0 && now.Sub(c.usedAt) > idle:
+		return false
+	}
+	c.refreshing = true
+	return true
+}
+
+// refreshToken replaces the token with a new one.
+// It retries with exponential backoff on failures.
+func (c *cachedDefaultCredentials) refreshToken() {
+	var token *oauth2.Token
+	cred, err := c.renew()
+	if err == nil {
+		token, err = cred.TokenSource.Token()
+	}
+
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+	c.refreshing = false
+	notRenewed := false
+	if err == nil && !token.Expiry.After(c.expiry) {
+		// e.g. tokens provided by metadata servers
+		err = fmt.Errorf("token is not renewed: expires at %v", token.Expiry)
+		notRenewed = true
+	}
+	if err != nil {
+		tokenMintFailuresTotal.WithLabelValues(c.account, c.scopesLabel, tokenMintRefresh).Inc()
+		backoff := tokenRefreshMaxBackoff
+		if c.failures < 6 {
+			backoff = tokenRefreshMinBackoff << c.failures
+		}
+		if backoff > tokenRefreshMaxBackoff {
+			backoff = tokenRefreshMaxBackoff
+		}
+		c.failures++
+		c.nextRefresh = time.Now().Add(backoff)
+		logger := log.WithError(err).
+			WithField(log.FieldAccount, c.account).
+			WithField(log.FieldScopes, c.scopes).
+			WithField("backoff", backoff)
+		if notRenewed {
+			// Retried until the token expires, and warned only once for each token.
+			if c.warnedExpiry.Equal(c.expiry) {
+				logger.Debug("Failed to refresh token in background")
+				return
+			}
+			c.warnedExpiry = c.expiry
+		}
+		logger.Warning("Failed to refresh token in background")
+		return
+	}
+	tokenMintsTotal.WithLabelValues(c.account, c.scopesLabel, tokenMintRefresh).Inc()
+	c.failures = 0
+	c.nextRefresh = time.Time{}
+	c.tokenSource = cred.TokenSource
+	c.expiry = token.Expiry
+	log.WithField(log.FieldAccount, c.account).
+		WithField(log.FieldScopes, c.scopes).
+		WithField("expiry", token.Expiry.Format(time.RFC3339)).
+		Debug("Token is refreshed in background")
+}
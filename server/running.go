@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// runningState is states of the running server kept across reloads
+type runningState struct {
+	// reloadMutex serializes reloads
+	reloadMutex sync.Mutex
+
+	mutex       sync.RWMutex
+	current     *Server
+	httpServers []*http.Server
+
+	shutdownOnce sync.Once
+	// shuttingDown is closed when the server is shutting down
+	shuttingDown chan struct{}
+
+	metrics *prometheus.Registry
+}
+
+func newRunningState() *runningState {
+	r := &runningState{
+		shuttingDown: make(chan struct{}),
+	}
+	r.metrics = newMetricsRegistry(r)
+	return r
+}
+
+// get returns the server with the current configuration.
+func (r *runningState) get() *Server {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.current
+}
+
+func (r *runningState) set(s *Server) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.current = s
+}
+
+// addHTTPServer registers srv to stop on shutdown.
+func (r *runningState) addHTTPServer(srv *http.Server) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.httpServers = append(r.httpServers, srv)
+}
+
+func (r *runningState) getHTTPServers() []*http.Server {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	servers := make([]*http.Server, len(r.httpServers))
+	copy(servers, r.httpServers)
+	return servers
+}
+
+// shutdown stops HTTP servers gracefully.
+func (r *runningState) shutdown(ctx context.Context) error {
+	r.shutdownOnce.Do(func() {
+		close(r.shuttingDown)
+	})
+	var firstErr error
+	for _, srv := range r.getHTTPServers() {
+		if err := srv.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// close stops HTTP servers immediately.
+func (r *runningState) close() {
+	r.shutdownOnce.Do(func() {
+		close(r.shuttingDown)
+	})
+	for _, srv := range r.getHTTPServers() {
+		srv.Close()
+	}
+}
@@ -5,19 +5,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/http"
-	"os"
-	"path/filepath"
+	"reflect"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/ikedam/gtokenserver/internal/util"
 	"github.com/ikedam/gtokenserver/log"
-
-	"golang.org/x/oauth2/google"
 )
 
 // Config is a configuration to the server to launch
@@ -26,60 +22,316 @@ type Config struct {
 	Port                         int
 	Scopes                       []string
 	Project                      string
-	CloudSDKConfig               string `mapstructure:"cloudsdk-config"`
-	GoogleApplicationCredentials string `mapstructure:"google-application-credentials"`
+	ProjectNumber                int64    `mapstructure:"project-number"`
+	CloudSDKConfig               string   `mapstructure:"cloudsdk-config"`
+	GoogleApplicationCredentials string   `mapstructure:"google-application-credentials"`
+	ImpersonateServiceAccount    string   `mapstructure:"impersonate-service-account"`
+	ImpersonateDelegates         []string `mapstructure:"impersonate-delegates"`
+	// Listen is URLs to listen like tcp://127.0.0.1:8080 or unix:///run/gtokenserver.sock.
+	// Host and Port are ignored if specified.
+	Listen []string
+	// ServiceAccounts configures multiple service accounts.
+	// Top-level credentials configurations are ignored if specified.
+	ServiceAccounts []ServiceAccountConfig `mapstructure:"service-accounts"`
+	// Clients maps clients to service accounts.
+	Clients []ClientConfig
+	// UnmatchedClients is the alias or the email of the service account for clients not in Clients.
+	// Defaults to the default service account. Specify "deny" to reject them.
+	UnmatchedClients string `mapstructure:"unmatched-clients"`
+	// Instance configures the emulated instance.
+	Instance InstanceConfig
+	// ProjectAttributes are custom metadata of the project.
+	ProjectAttributes Attributes `mapstructure:"project-attributes"`
+	// Admin configures the admin API to change metadata at runtime.
+	Admin AdminConfig
+	// Fake configures the fake mode issuing tokens without accessing Google.
+	Fake FakeConfig
+	// TokenCache configures the cache of tokens for scopes requested with the scopes parameter.
+	TokenCache TokenCacheConfig `mapstructure:"token-cache"`
+	// TokenRefresh configures refreshing tokens in background.
+	TokenRefresh TokenRefreshConfig `mapstructure:"token-refresh"`
+	// LinkLocal configures serving on the address of Google metadata servers.
+	LinkLocal LinkLocalConfig `mapstructure:"link-local"`
+	// Metrics configures Prometheus metrics.
+	Metrics MetricsConfig
+	// Audit configures the audit log of issued tokens.
+	Audit AuditConfig
+	// Tracing configures OpenTelemetry tracing.
+	Tracing TracingConfig
+	// ShutdownTimeout is the maximum duration to wait for active requests on shutdown.
+	ShutdownTimeout time.Duration `mapstructure:"shutdown-timeout"`
 }
 
+const defaultShutdownTimeout = 10 * time.Second
+
 // Server is an instance of gtokenserver
 type Server struct {
-	config                           Config
-	cache                            *cachedDefaultCredentials
-	warnGoogleApplicationCredentials bool
-	warnCoudSDKConfig                bool
+	config          Config
+	accounts        []*serviceAccount
+	clients         *clientResolver
+	metadataChanged *changeNotifier
+	overrides       *metadataOverrides
+	fake            *fakeIssuer
+	tokens          *tokenCache
+	audit           *auditor
+	router          http.Handler
+	adminRouter     http.Handler
+	// running is shared with servers reloaded from this server
+	running *runningState
 }
 
 // NewServer creates a Server
-func NewServer(config *Config) *Server {
-	return &Server{
-		config: *config,
+func NewServer(config *Config) (*Server, error) {
+	s, err := newServer(config, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.running.set(s)
+	return s, nil
+}
+
+// newServer creates a Server.
+// previous is the server to reload, or nil.
+func newServer(config *Config, previous *Server) (*Server, error) {
+	running := newRunningState()
+	metadataChanged := newChangeNotifier()
+	overrides := newMetadataOverrides()
+	var previousFake *fakeIssuer
+	var previousAccounts []*serviceAccount
+	if previous != nil {
+		// Kept across reloads.
+		running = previous.running
+		metadataChanged = previous.metadataChanged
+		overrides = previous.overrides
+		previousFake = previous.fake
+		previousAccounts = previous.accounts
+	}
+	var fake *fakeIssuer
+	if previous != nil && previous.config.Fake == config.Fake && previous.config.Project == config.Project {
+		fake = previous.fake
+	} else {
+		var err error
+		fake, err = newFakeIssuer(config, previousFake)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var tokens *tokenCache
+	if previous != nil && previous.config.TokenCache == config.TokenCache {
+		tokens = previous.tokens
+	} else {
+		tokens = newTokenCache(config.TokenCache)
+	}
+	accounts, err := buildServiceAccounts(config, fake, tokens)
+	if err != nil {
+		return nil, err
+	}
+	// Keep cached credentials of service accounts not changed.
+	reuseServiceAccounts(accounts, previousAccounts)
+	clients, err := newClientResolver(config, accounts)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Admin.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.TokenRefresh.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.LinkLocal.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Tracing.validate(); err != nil {
+		return nil, err
 	}
+	// Opened last not to leak the file on errors above.
+	// The previous file is closed in Reload.
+	var audit *auditor
+	if previous != nil && previous.config.Audit == config.Audit {
+		audit = previous.audit
+	} else {
+		audit, err = newAuditor(config.Audit)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s := &Server{
+		config:          *config,
+		accounts:        accounts,
+		clients:         clients,
+		metadataChanged: metadataChanged,
+		overrides:       overrides,
+		fake:            fake,
+		tokens:          tokens,
+		audit:           audit,
+		running:         running,
+	}
+	s.router = s.buildRouter()
+	s.adminRouter = s.buildAdminRouter()
+	return s, nil
 }
 
-// Serve launches an instance of gtokenserver
-func (s *Server) Serve() error {
+func (s *Server) buildRouter() http.Handler {
 	r := mux.NewRouter()
 	r.NotFoundHandler = http.HandlerFunc(s.notFound)
 	r.HandleFunc("/", s.handleRoot)
+	// Served without Metadata-Flavor for health checks and monitoring.
+	r.HandleFunc(healthzPath, s.handleHealthz)
+	r.HandleFunc(readyzPath, s.handleReadyz)
+	r.Handle(statusPath, s.clientMiddleware(http.HandlerFunc(s.handleStatus)))
+	if s.config.Metrics.Enabled {
+		r.Handle(metricsPath, s.handleMetrics())
+	}
+	if s.fake != nil {
+		r.HandleFunc(fakeJWKSPath, s.handleFakeJWKS)
+		r.HandleFunc(fakeOpenIDConfigPath, s.handleFakeOpenIDConfiguration)
+	}
 
-	computeMetadataV1 := r.PathPrefix("/computeMetadata/v1").Subrouter()
+	computeMetadataV1 := r.PathPrefix(metadataRoot).Subrouter()
 	computeMetadataV1.Use(checkMetadataFlavorMiddleware)
-	project := computeMetadataV1.PathPrefix("/project").Subrouter()
-	project.HandleFunc("/project-id", s.handleProjectProjectID)
-	project.HandleFunc("/numeric-project-id", s.handleProjectNumericProjectID)
-
-	serviceAccounts := computeMetadataV1.PathPrefix("/instance/service-accounts").Subrouter()
-	serviceAccounts.HandleFunc("/", s.handleServiceAccounts)
-
-	serviceAccount := serviceAccounts.PathPrefix("/{account}").Subrouter()
-	serviceAccount.Use(s.serviceAccountMiddleware)
-	serviceAccount.HandleFunc("/", s.handleServiceAccount)
-	serviceAccount.HandleFunc("/email", s.handleServiceAccountEmail)
-	serviceAccount.HandleFunc("/token", s.handleServiceAccountToken)
-	serviceAccount.HandleFunc("/identity", s.handleServiceAccountIdentity)
+	computeMetadataV1.Use(s.auditMiddleware)
+	computeMetadataV1.Use(s.clientMiddleware)
+	computeMetadataV1.Handle(
+		"/instance/service-accounts/{account}/token",
+		s.serviceAccountMiddleware(http.HandlerFunc(s.handleServiceAccountToken)),
+	).Name(auditRouteToken)
+	computeMetadataV1.Handle(
+		"/instance/service-accounts/{account}/identity",
+		s.serviceAccountMiddleware(http.HandlerFunc(s.handleServiceAccountIdentity)),
+	).Name(auditRouteIdentity)
+	computeMetadataV1.PathPrefix("/").HandlerFunc(s.handleMetadata)
+	return instrumentRouter(r)
+}
 
-	hostport := fmt.Sprintf("%v:%v", s.config.Host, s.config.Port)
-	addr, err := net.Listen("tcp", hostport)
+// Serve launches an instance of gtokenserver.
+// It serves until ctx is done or Shutdown is called.
+// When ctx is done, it waits for active requests up to shutdown-timeout.
+func (s *Server) Serve(ctx context.Context) error {
+	listeners, err := s.listen()
 	if err != nil {
-		return fmt.Errorf("failed to listen %v: %w", hostport, err)
+		return err
 	}
-	defer addr.Close()
+	linkLocalListener, linkLocal, err := s.listenLinkLocal()
+	if err != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return err
+	}
+	if linkLocal != nil {
+		// Called after listeners are closed.
+		defer linkLocal.cleanup()
+		listeners = append(listeners, linkLocalListener)
+	}
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	shutdownTracing, err := startTracing(ctx, s.config.Tracing)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Flush traces even after ctx is done.
+		flushCtx, cancel := context.WithTimeout(context.Background(), tracingFlushTimeout)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			log.WithError(err).Warning("Failed to flush traces")
+		}
+	}()
 	srv := &http.Server{
-		Handler: util.InstallHTTPLogger(r),
+		// Requests are handled with the configuration at the time.
+		Handler: traceHandler(util.InstallHTTPLogger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.running.get().router.ServeHTTP(w, r)
+		}))),
+	}
+	s.running.addHTTPServer(srv)
+	if err := s.serveAdmin(); err != nil {
+		return err
+	}
+	refreshCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.refreshTokens(refreshCtx)
+
+	served := make(chan error, len(listeners))
+	for _, l := range listeners {
+		log.WithField("address", l.Addr().String()).Info("Listening")
+		go func(l net.Listener) {
+			served <- srv.Serve(l)
+		}(l)
 	}
+	select {
+	case err := <-served:
+		if err == http.ErrServerClosed {
+			// Shutdown is called.
+			return nil
+		}
+		s.running.close()
+		return err
+	case <-ctx.Done():
+	}
+
+	timeout := s.running.get().config.ShutdownTimeout
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+	log.WithField("timeout", timeout).Info("Shutting down...")
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), timeout)
+	defer cancelShutdown()
+	return s.Shutdown(shutdownCtx)
+}
 
-	log.Infof("Listening %v...", addr.Addr().String())
+// Shutdown stops the server gracefully waiting for active requests until ctx is done.
+// Requests waiting for changes with wait_for_change return immediately.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.running.shutdown(ctx)
+}
 
-	return srv.Serve(addr)
+// Reload replaces the configuration of the running server.
+// Requests in progress are handled with the previous configuration.
+// Cached credentials are discarded only for changed service accounts.
+// Changes of addresses to listen require restart.
+func (s *Server) Reload(config *Config) error {
+	s.running.reloadMutex.Lock()
+	defer s.running.reloadMutex.Unlock()
+	current := s.running.get()
+	diffs := diffConfigs(&current.config, config)
+	if len(diffs) == 0 {
+		log.Debug("Configuration is not changed")
+		return nil
+	}
+	next, err := newServer(config, current)
+	if err != nil {
+		return err
+	}
+	for _, diff := range diffs {
+		log.WithField("change", diff).Info("Configuration is changed")
+	}
+	if next.config.Host != current.config.Host ||
+		next.config.Port != current.config.Port ||
+		!reflect.DeepEqual(next.config.Listen, current.config.Listen) ||
+		next.config.LinkLocal != current.config.LinkLocal ||
+		next.config.Tracing != current.config.Tracing ||
+		next.config.Admin.Host != current.config.Admin.Host ||
+		next.config.Admin.Port != current.config.Admin.Port {
+		log.Warning("Changes of host, port, listen, link-local, tracing, admin.host and admin.port are ignored until restart")
+		next.config.Host = current.config.Host
+		next.config.Port = current.config.Port
+		next.config.Listen = current.config.Listen
+		next.config.LinkLocal = current.config.LinkLocal
+		next.config.Tracing = current.config.Tracing
+		next.config.Admin.Host = current.config.Admin.Host
+		next.config.Admin.Port = current.config.Admin.Port
+	}
+	s.running.set(next)
+	if current.audit != next.audit {
+		// Closed after requests in progress finish recording.
+		current.audit.Close()
+	}
+	log.Info("Configuration is reloaded")
+	s.metadataChanged.notify()
+	return nil
 }
 
 func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
@@ -92,7 +344,8 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 func checkMetadataFlavorMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("Metadata-Flavor") != "Google" {
-			log.WithField("method", r.Method).
+			log.FromContext(r.Context()).
+				WithField("method", r.Method).
 				WithField("path", r.URL.Path).
 				Debug("Accessed without Metadata-Flavor: Google")
 			w.WriteHeader(http.StatusNotFound)
@@ -102,219 +355,46 @@ func checkMetadataFlavorMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func (s *Server) credentialsFromFile(ctx context.Context, file string, scopes ...string) (*google.Credentials, error) {
-	body, err := ioutil.ReadFile(file)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read from %v: %w", file, err)
-	}
-	return google.CredentialsFromJSON(ctx, body, scopes...)
-}
-
-func (s *Server) findCredentials(scopes ...string) (*google.Credentials, error) {
-	ctx := context.Background()
-	if s.config.GoogleApplicationCredentials != "" {
-		file, err := os.Stat(s.config.GoogleApplicationCredentials)
-		if !os.IsNotExist(err) && !file.IsDir() {
-			cred, err := s.credentialsFromFile(ctx, s.config.GoogleApplicationCredentials, scopes...)
-			if err == nil { // Be careful: not != but ==
-				s.warnGoogleApplicationCredentials = false
-				return cred, nil
-			}
-			if !s.warnGoogleApplicationCredentials {
-				s.warnGoogleApplicationCredentials = true
-				log.WithError(err).
-					WithField("file", s.config.GoogleApplicationCredentials).
-					Warning("Failed to load specified credentials file: ignored.")
-			}
-		} else {
-			if !s.warnGoogleApplicationCredentials {
-				s.warnGoogleApplicationCredentials = true
-				log.WithField("file", s.config.GoogleApplicationCredentials).
-					Warning("Failed to stat specified credentials file: ignored.")
-			}
-		}
-	}
-	cloudSDKConfig := s.config.CloudSDKConfig
-	if cloudSDKConfig == "" {
-		// CLOUDSDK_CONFIG doesn't supported in golang oauth2 library.
-		// See: https://github.com/googleapis/google-cloud-go/issues/288
-		cloudSDKConfig = os.Getenv("CLOUDSDK_CONFIG")
-	}
-	if cloudSDKConfig != "" {
-		applicationConfig := filepath.Join(cloudSDKConfig, "application_default_credentials.json")
-		file, err := os.Stat(applicationConfig)
-		if !os.IsNotExist(err) && !file.IsDir() {
-			cred, err := s.credentialsFromFile(ctx, applicationConfig, scopes...)
-			if err == nil { // Be careful: not != but ==
-				s.warnCoudSDKConfig = false
-				return cred, nil
-			}
-			if !s.warnCoudSDKConfig {
-				s.warnCoudSDKConfig = true
-				log.WithError(err).
-					WithField("directory", applicationConfig).
-					Warning("Failed to load credentials from specified cloud-sdk configuration directory: ignored.")
-			}
-		}
-	}
-	return google.FindDefaultCredentials(ctx, scopes...)
+func (s *Server) getCredentials(ctx context.Context) *cachedDefaultCredentials {
+	return s.getClientProfileFromContext(ctx).defaultAccount.getCredentials(ctx)
 }
 
-func (s *Server) getCredentials(scopes ...string) *cachedDefaultCredentials {
-	actualScopes := scopes
-	if scopes == nil {
-		actualScopes = s.config.Scopes
-	}
-	cred, err := s.findCredentials(actualScopes...)
-	if err != nil {
-		log.WithError(err).
-			Error(
-				"Could not retrieve default credentials\n" +
-					"You may haven't set up credentials. You can set up your credentials in one of those ways:\n" +
-					"\n" +
-					"  * Run `gcloud auth application-default login`. Share /root/.config/gcloud with volume mounts in docker containers.\n" +
-					"  * Put the service account key file (a json file), and specify the path with GOOGLE_APPLICATION_CREDENTIALS environment variable.\n" +
-					"\n\n",
-			)
-		return nil
-	}
-	newCache, err := newCachedDefaultCredentials(cred, s.config.Project)
-	if err != nil {
-		log.WithError(err).
-			Error("Could not resolve default credentials")
-		return nil
-	}
-	if scopes != nil {
-		// Don't cache if scopes are explicitly specified.
-		return newCache
-	}
-	cached := s.cache
-	if cached != nil && cached.ClientID == newCache.ClientID {
-		return cached
-	}
-	s.cache = newCache
-	email, err := s.cache.GetEmail()
-	if err == nil { // Be careful: not err != nil, but err == nil
-		log.Infof("New credentials: %v", email)
-	} else {
-		log.Infof("New credentials: client_id=%v", newCache.ClientID)
-	}
-	return newCache
-}
-
-func (s *Server) handleProjectProjectID(w http.ResponseWriter, r *http.Request) {
-	cred := s.getCredentials()
-	if cred == nil {
-		s.writeTextResponse(w, "")
-		return
-	}
-	s.writeTextResponse(w, cred.ProjectID)
-}
-
-func (s *Server) handleProjectNumericProjectID(w http.ResponseWriter, r *http.Request) {
-	cred := s.getCredentials()
-	if cred == nil {
-		s.writeTextResponse(w, "0")
-		return
-	}
-	numericProjectID, err := cred.GetNumericProjectID()
-	if err != nil {
-		log.WithError(err).Error("Failed to resolve numeric project id")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	s.writeTextResponse(w, fmt.Sprintf("%v", numericProjectID))
-}
-
-func (s *Server) handleServiceAccounts(w http.ResponseWriter, r *http.Request) {
-	cred := s.getCredentials()
-	if cred == nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	email, err := cred.GetEmail()
-	if err != nil {
-		log.WithError(err).
-			Error("Could not retrieve email of the credential")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	s.writeTextResponse(w, fmt.Sprintf("default/\n%s\n", email))
-}
-
-var credentialsKey = "credentials"
+var (
+	accountKey     = "account"
+	credentialsKey = "credentials"
+)
 
 func (s *Server) serviceAccountMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cred := s.getCredentials()
-		if cred == nil {
-			return
-		}
-		r = r.WithContext(context.WithValue(r.Context(), &credentialsKey, cred))
-
 		vars := mux.Vars(r)
-		if vars["account"] == "default" {
-			next.ServeHTTP(w, r)
+		account := s.getClientProfileFromContext(r.Context()).findAccount(r.Context(), vars["account"])
+		if account == nil {
+			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-
-		// verify email
-		email, err := cred.GetEmail()
-		if err != nil {
-			log.WithError(err).
-				Error("Could not retrieve email of the credential")
+		cred := account.getCredentials(r.Context())
+		if cred == nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		if vars["account"] != email {
-			w.WriteHeader(http.StatusNotFound)
-			return
+		if record := getAuditRecordFromContext(r.Context()); record != nil {
+			if email, err := cred.GetEmail(r.Context()); err == nil {
+				record.Account = email
+			}
 		}
-		next.ServeHTTP(w, r)
+		ctx := context.WithValue(r.Context(), &accountKey, account)
+		ctx = context.WithValue(ctx, &credentialsKey, cred)
+		ctx = log.NewContext(ctx, log.FromContext(ctx).WithField(log.FieldAccount, account.name()))
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-func (s *Server) getCredentialsFromContext(ctx context.Context) *cachedDefaultCredentials {
-	return ctx.Value(&credentialsKey).(*cachedDefaultCredentials)
-}
-
-type serviceAccountRecursiveResponse struct {
-	Scopes  []string `json:"scopes"`
-	Email   string   `json:"email"`
-	Aliases []string `json:"aliases"`
+func (s *Server) getAccountFromContext(ctx context.Context) *serviceAccount {
+	return ctx.Value(&accountKey).(*serviceAccount)
 }
 
-func (s *Server) handleServiceAccount(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Query().Get("recursive") != "true" {
-		s.writeTextResponse(w, "email/\nscopes/\ntoken\n")
-		return
-	}
-	cred := s.getCredentialsFromContext(r.Context())
-	email, err := cred.GetEmail()
-	if err != nil {
-		log.WithError(err).
-			Error("Could not retrieve email of the credential")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	response := serviceAccountRecursiveResponse{
-		Scopes:  s.config.Scopes,
-		Email:   email,
-		Aliases: []string{"default"},
-	}
-	s.writeJSONResponse(w, &response)
-}
-
-func (s *Server) handleServiceAccountEmail(w http.ResponseWriter, r *http.Request) {
-	cred := s.getCredentialsFromContext(r.Context())
-	email, err := cred.GetEmail()
-	if err != nil {
-		log.WithError(err).
-			Error("Could not retrieve email of the credential")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	s.writeTextResponse(w, email)
+func (s *Server) getCredentialsFromContext(ctx context.Context) *cachedDefaultCredentials {
+	return ctx.Value(&credentialsKey).(*cachedDefaultCredentials)
 }
 
 type tokenResponse struct {
@@ -327,19 +407,30 @@ func (s *Server) handleServiceAccountToken(w http.ResponseWriter, r *http.Reques
 	cred := s.getCredentialsFromContext(r.Context())
 	scopes := r.URL.Query().Get("scopes")
 	if scopes != "" {
-		cred = s.getCredentials(strings.Split(r.URL.Query().Get("scopes"), ",")...)
+		account := s.getAccountFromContext(r.Context())
+		cred = account.getCredentials(r.Context(), strings.Split(scopes, ",")...)
 		if cred == nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 	}
-	token, err := cred.Token()
+	record := getAuditRecordFromContext(r.Context())
+	if record != nil {
+		record.Scopes = strings.Fields(cred.scopes)
+	}
+	token, err := cred.Token(r.Context())
 	if err != nil {
-		log.WithError(err).
+		log.FromContext(r.Context()).
+			WithError(err).
+			WithField(log.FieldScopes, cred.scopes).
 			Error("Could not retrieve token")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if record != nil {
+		record.Fingerprint = tokenFingerprint(token.AccessToken)
+		record.Expiry = optionalTime(token.Expiry)
+	}
 	s.writeJSONResponse(w, &tokenResponse{
 		AccessToken: token.AccessToken,
 		TokenType:   token.TokenType,
@@ -348,8 +439,40 @@ func (s *Server) handleServiceAccountToken(w http.ResponseWriter, r *http.Reques
 }
 
 func (s *Server) handleServiceAccountIdentity(w http.ResponseWriter, r *http.Request) {
-	log.Warningf("/identity endpoint is not supported.")
-	w.WriteHeader(http.StatusNotFound)
+	cred := s.getCredentialsFromContext(r.Context())
+	audience := r.URL.Query().Get("audience")
+	if audience == "" {
+		s.writeErrorResponse(w, http.StatusBadRequest, "non-empty audience parameter required")
+		return
+	}
+	// "full" results in tokens with email claims.
+	// Claims specific to Compute Engine are never included.
+	// licenses is meaningful only on Compute Engine and ignored.
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "standard", "full":
+	default:
+		s.writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid format: %v", format))
+		return
+	}
+	record := getAuditRecordFromContext(r.Context())
+	if record != nil {
+		record.Audience = audience
+	}
+	token, err := cred.IDToken(r.Context(), audience, format == "full")
+	if err != nil {
+		log.FromContext(r.Context()).
+			WithError(err).
+			WithField("audience", audience).
+			Error("Could not retrieve ID token")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if record != nil {
+		record.Fingerprint = tokenFingerprint(token)
+		record.Expiry = idTokenExpiry(token)
+	}
+	s.writeTextResponse(w, token)
 }
 
 func (s *Server) writeTextResponse(w http.ResponseWriter, text string) {
@@ -358,6 +481,13 @@ func (s *Server) writeTextResponse(w http.ResponseWriter, text string) {
 	w.Write([]byte(text))
 }
 
+func (s *Server) writeErrorResponse(w http.ResponseWriter, code int, text string) {
+	w.Header().Add("Metadata-Flavor", "Google")
+	w.Header().Add("Content-Type", "application/text")
+	w.WriteHeader(code)
+	w.Write([]byte(text))
+}
+
 func (s *Server) writeJSONResponse(w http.ResponseWriter, obj interface{}) {
 	body, err := json.Marshal(obj)
 	if err != nil {
@@ -373,7 +503,8 @@ func (s *Server) writeJSONResponse(w http.ResponseWriter, obj interface{}) {
 }
 
 func (s *Server) notFound(w http.ResponseWriter, r *http.Request) {
-	log.WithField("method", r.Method).
+	log.FromContext(r.Context()).
+		WithField("method", r.Method).
 		WithField("path", r.RequestURI).
 		Warning(
 			"Unimplemented path is accessed: " +
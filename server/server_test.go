@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"crypto/rsa"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+// newTestServer starts the server behind httptest.Server.
+func newTestServer(t *testing.T, config *Config) *httptest.Server {
+	t.Helper()
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("failed to create the server: %v", err)
+	}
+	ts := httptest.NewServer(s.router)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// newFakeTestServer starts the server in the fake mode behind httptest.Server.
+func newFakeTestServer(t *testing.T, config *Config) *httptest.Server {
+	t.Helper()
+	config.Fake.Enabled = true
+	return newTestServer(t, config)
+}
+
+func getMetadata(t *testing.T, ts *httptest.Server, path string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, ts.URL+metadataRoot+path, nil)
+	if err != nil {
+		t.Fatalf("failed to build the request: %v", err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("failed to request %v: %v", path, err)
+		return 0, ""
+	}
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		t.Errorf("failed to read the response of %v: %v", path, err)
+	}
+	return rsp.StatusCode, string(body)
+}
+
+// slowDown makes loading credentials and looking up emails slow
+// so that concurrent requests overlap, and returns counters of loads of credentials and email lookups.
+func slowDown(t *testing.T, delay time.Duration) (*int32, *int32) {
+	t.Helper()
+	var credentialLoads, emailLookups int32
+	originalNewFakeCredentials := newFakeCredentials
+	originalGetEmailOfCredentials := getEmailOfCredentials
+	newFakeCredentials = func(email, projectID, issuer string, key *rsa.PrivateKey, scopes ...string) (*google.Credentials, error) {
+		atomic.AddInt32(&credentialLoads, 1)
+		time.Sleep(delay)
+		return originalNewFakeCredentials(email, projectID, issuer, key, scopes...)
+	}
+	getEmailOfCredentials = func(ctx context.Context, cred *google.Credentials) (string, error) {
+		atomic.AddInt32(&emailLookups, 1)
+		time.Sleep(delay)
+		return originalGetEmailOfCredentials(ctx, cred)
+	}
+	t.Cleanup(func() {
+		newFakeCredentials = originalNewFakeCredentials
+		getEmailOfCredentials = originalGetEmailOfCredentials
+	})
+	return &credentialLoads, &emailLookups
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	credentialLoads, emailLookups := slowDown(t, 100*time.Millisecond)
+	ts := newFakeTestServer(t, &Config{
+		Scopes: []string{"https://www.googleapis.com/auth/cloud-platform"},
+	})
+	const concurrency = 20
+	paths := []string{
+		"/instance/service-accounts/default/token",
+		"/instance/service-accounts/default/email",
+		"/instance/service-accounts/default/identity?audience=https://example.com",
+	}
+	var wg sync.WaitGroup
+	results := make([][]string, len(paths))
+	for i, path := range paths {
+		results[i] = make([]string, concurrency)
+		for j := 0; j < concurrency; j++ {
+			wg.Add(1)
+			go func(i, j int, path string) {
+				defer wg.Done()
+				code, body := getMetadata(t, ts, path)
+				if code != http.StatusOK {
+					t.Errorf("%v: expected %v but got %v: %v", path, http.StatusOK, code, body)
+				}
+				results[i][j] = body
+			}(i, j, path)
+		}
+	}
+	wg.Wait()
+
+	for i, path := range paths {
+		for _, body := range results[i] {
+			if body != results[i][0] {
+				t.Errorf("%v: responses differ: %q and %q", path, results[i][0], body)
+				break
+			}
+		}
+	}
+	if email := results[1][0]; !strings.HasSuffix(email, "@fake-project.iam.gserviceaccount.com") {
+		t.Errorf("unexpected email: %v", email)
+	}
+	if got := atomic.LoadInt32(credentialLoads); got != 1 {
+		t.Errorf("expected a single load of credentials but got %v", got)
+	}
+	if got := atomic.LoadInt32(emailLookups); got != 1 {
+		t.Errorf("expected a single email lookup but got %v", got)
+	}
+}
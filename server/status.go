@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+	statusPath  = "/status"
+)
+
+// serviceAccountStatus is a status of a service account in /status
+type serviceAccountStatus struct {
+	Alias   string `json:"alias,omitempty"`
+	Email   string `json:"email,omitempty"`
+	Default bool   `json:"default"`
+	// Source is the file credentials are loaded from
+	Source                    string     `json:"source,omitempty"`
+	ImpersonateServiceAccount string     `json:"impersonateServiceAccount,omitempty"`
+	Project                   string     `json:"project,omitempty"`
+	Scopes                    []string   `json:"scopes"`
+	TokenExpiry               *time.Time `json:"tokenExpiry,omitempty"`
+	Error                     string     `json:"error,omitempty"`
+}
+
+// scopedTokenStatus is a status of credentials for requested scopes in /status
+type scopedTokenStatus struct {
+	ServiceAccount string     `json:"serviceAccount"`
+	Scopes         []string   `json:"scopes"`
+	TokenExpiry    *time.Time `json:"tokenExpiry,omitempty"`
+}
+
+type statusResponse struct {
+	Project         string                  `json:"project,omitempty"`
+	Fake            bool                    `json:"fake"`
+	ServiceAccounts []*serviceAccountStatus `json:"serviceAccounts"`
+	ScopedTokens    []*scopedTokenStatus    `json:"scopedTokens"`
+}
+
+// handleHealthz responds whenever the process is alive.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	s.writeTextResponse(w, "ok\n")
+}
+
+// handleReadyz responds successfully when tokens are available for all service accounts.
+// Tokens are reused until they expire, and minted only when not available.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	var failures []string
+	for _, account := range s.accounts {
+		cred := account.getCredentials(r.Context())
+		if cred == nil {
+			failures = append(failures, fmt.Sprintf("%v: credentials are not available\n", account.name()))
+			continue
+		}
+		if _, err := cred.Token(r.Context()); err != nil {
+			failures = append(failures, fmt.Sprintf("%v: failed to get a token: %v\n", account.name(), err))
+		}
+	}
+	if len(failures) > 0 {
+		s.writeErrorResponse(w, http.StatusServiceUnavailable, strings.Join(failures, ""))
+		return
+	}
+	s.writeTextResponse(w, "ok\n")
+}
+
+// handleStatus shows service accounts visible to the client.
+// It doesn't request tokens except to resolve emails of user accounts.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	profile := s.getClientProfileFromContext(r.Context())
+	rsp := &statusResponse{
+		Project:         s.config.Project,
+		Fake:            s.fake != nil,
+		ServiceAccounts: make([]*serviceAccountStatus, 0, len(profile.accounts)),
+		ScopedTokens:    make([]*scopedTokenStatus, 0),
+	}
+	if s.fake != nil {
+		rsp.Project = s.fake.project
+	}
+	names := make(map[*serviceAccount]string)
+	for _, account := range profile.accounts {
+		status := account.status(r.Context())
+		status.Default = account == profile.defaultAccount
+		rsp.ServiceAccounts = append(rsp.ServiceAccounts, status)
+		names[account] = status.Email
+		if status.Email == "" {
+			names[account] = account.name()
+		}
+	}
+	for _, entry := range s.tokens.listEntries() {
+		name, ok := names[entry.key.account]
+		if !ok {
+			// Not visible to the client or the account is reloaded.
+			continue
+		}
+		rsp.ScopedTokens = append(rsp.ScopedTokens, &scopedTokenStatus{
+			ServiceAccount: name,
+			Scopes:         strings.Split(entry.key.scopes, " "),
+			TokenExpiry:    optionalTime(entry.cred.tokenExpiry()),
+		})
+	}
+	s.writeJSONResponse(w, rsp)
+}
+
+func (a *serviceAccount) status(ctx context.Context) *serviceAccountStatus {
+	status := &serviceAccountStatus{
+		Alias:                     a.config.Alias,
+		ImpersonateServiceAccount: a.config.ImpersonateServiceAccount,
+		Scopes:                    a.config.Scopes,
+	}
+	cred := a.getCredentials(ctx)
+	if cred == nil {
+		status.Error = "credentials are not available"
+		return status
+	}
+	status.Source = cred.Source
+	status.Project = cred.ProjectID
+	status.TokenExpiry = optionalTime(cred.tokenExpiry())
+	email, err := cred.GetEmail(ctx)
+	if err != nil {
+		status.Error = fmt.Sprintf("failed to resolve the email: %v", err)
+		return status
+	}
+	status.Email = email
+	return status
+}
+
+// optionalTime returns nil for the zero time to omit it in JSON.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
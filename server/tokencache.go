@@ -0,0 +1,177 @@
+package server
+
+import (
+	"container/list"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenCacheConfig is a configuration of the cache of credentials
+// for scopes requested with the scopes parameter
+type TokenCacheConfig struct {
+	// Size is the maximum number of cached scope sets. Defaults to 100.
+	// Specify a negative value to disable the cache.
+	Size int
+	// TTL is the maximum duration to keep credentials in the cache. Defaults to 1h.
+	// Tokens are refreshed in the cache when they expire.
+	TTL time.Duration
+}
+
+const (
+	defaultTokenCacheSize = 100
+	defaultTokenCacheTTL  = time.Hour
+)
+
+// normalizeScopes returns sorted and deduplicated scopes.
+func normalizeScopes(scopes []string) []string {
+	seen := make(map[string]bool)
+	normalized := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		scope = strings.TrimSpace(scope)
+		if scope == "" || seen[scope] {
+			continue
+		}
+		seen[scope] = true
+		normalized = append(normalized, scope)
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// tokenCacheKey identifies credentials in tokenCache
+type tokenCacheKey struct {
+	account *serviceAccount
+	// stamp changes when credentials of the account are reloaded
+	stamp  string
+	scopes string
+}
+
+type tokenCacheEntry struct {
+	key       tokenCacheKey
+	cred      *cachedDefaultCredentials
+	expiresAt time.Time
+}
+
+// tokenCacheStats is statistics of tokenCache
+type tokenCacheStats struct {
+	Size      int    `json:"size"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// tokenCache is a LRU cache of credentials for requested scopes.
+// Credentials hold token sources reusing tokens until they expire.
+// It's safe for concurrent use.
+type tokenCache struct {
+	size int
+	ttl  time.Duration
+
+	mutex   sync.Mutex
+	entries map[tokenCacheKey]*list.Element
+	lru     *list.List
+	stats   tokenCacheStats
+}
+
+func newTokenCache(config TokenCacheConfig) *tokenCache {
+	size := config.Size
+	if size == 0 {
+		size = defaultTokenCacheSize
+	}
+	ttl := config.TTL
+	if ttl == 0 {
+		ttl = defaultTokenCacheTTL
+	}
+	return &tokenCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[tokenCacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns nil if not cached.
+func (c *tokenCache) get(key tokenCacheKey) *cachedDefaultCredentials {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		tokenCacheMissesTotal.Inc()
+		return nil
+	}
+	entry := element.Value.(*tokenCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.remove(element)
+		c.stats.Misses++
+		tokenCacheMissesTotal.Inc()
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	c.stats.Hits++
+	tokenCacheHitsTotal.Inc()
+	return entry.cred
+}
+
+func (c *tokenCache) add(key tokenCacheKey, cred *cachedDefaultCredentials) {
+	if c.size < 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	c.entries[key] = c.lru.PushFront(&tokenCacheEntry{
+		key:       key,
+		cred:      cred,
+		expiresAt: time.Now().Add(c.ttl),
+	})
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+		tokenCacheEvictionsTotal.Inc()
+	}
+}
+
+// remove must be called with mutex locked.
+func (c *tokenCache) remove(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*tokenCacheEntry).key)
+}
+
+// list returns credentials in the cache not expired.
+func (c *tokenCache) list() []*cachedDefaultCredentials {
+	entries := c.listEntries()
+	creds := make([]*cachedDefaultCredentials, 0, len(entries))
+	for _, entry := range entries {
+		creds = append(creds, entry.cred)
+	}
+	return creds
+}
+
+// listEntries returns entries in the cache not expired.
+// Entries must not be modified.
+func (c *tokenCache) listEntries() []*tokenCacheEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	entries := make([]*tokenCacheEntry, 0, c.lru.Len())
+	for element := c.lru.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*tokenCacheEntry)
+		if now.Before(entry.expiresAt) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func (c *tokenCache) getStats() tokenCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := c.stats
+	stats.Size = c.lru.Len()
+	return stats
+}
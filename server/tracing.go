@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ikedam/gtokenserver/log"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpgrpc"
+	"go.opentelemetry.io/otel/exporters/stdout"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Names of exporters of traces.
+const (
+	TracingExporterOTLP   = "otlp"
+	TracingExporterStdout = "stdout"
+)
+
+// tracingServiceName is service.name of traces
+const tracingServiceName = "gtokenserver"
+
+// tracer starts spans of gtokenserver with the global tracer provider
+var tracer = otel.Tracer(tracingServiceName)
+
+// attributeTokenMinted tells whether a new token is issued for the request
+const attributeTokenMinted = attribute.Key("gtokenserver.token.minted")
+
+// tracingFlushTimeout is the maximum duration to export remaining traces on shutdown
+const tracingFlushTimeout = 5 * time.Second
+
+// TracingConfig is a configuration of OpenTelemetry tracing
+type TracingConfig struct {
+	// Exporter is otlp or stdout. Tracing is disabled if not specified.
+	Exporter string
+	// Endpoint is host:port of the OTLP gRPC collector. Defaults to localhost:4317.
+	Endpoint string
+	// Insecure disables TLS to the collector.
+	Insecure bool
+	// SampleRatio is the ratio of requests traced without sampled parents. Defaults to 1.
+	SampleRatio float64 `mapstructure:"sample-ratio"`
+}
+
+func (c *TracingConfig) validate() error {
+	switch strings.ToLower(c.Exporter) {
+	case "", TracingExporterOTLP, TracingExporterStdout:
+	default:
+		return fmt.Errorf("invalid tracing.exporter %v: must be otlp or stdout", c.Exporter)
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return fmt.Errorf("invalid tracing.sample-ratio %v: must be between 0 and 1", c.SampleRatio)
+	}
+	return nil
+}
+
+// startTracing configures the global tracer provider and propagators.
+// The returned function flushes and stops exporting traces.
+func startTracing(ctx context.Context, config TracingConfig) (func(context.Context) error, error) {
+	if config.Exporter == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	// Errors are reported also while starting exporters.
+	otel.SetErrorHandler(tracingErrorHandler{})
+	var exporter sdktrace.SpanExporter
+	switch strings.ToLower(config.Exporter) {
+	case TracingExporterOTLP:
+		options := []otlpgrpc.Option{}
+		if config.Endpoint != "" {
+			options = append(options, otlpgrpc.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			options = append(options, otlpgrpc.WithInsecure())
+		}
+		otlpExporter, err := otlp.NewExporter(ctx, otlpgrpc.NewDriver(options...))
+		if err != nil {
+			return nil, fmt.Errorf("failed to start the OTLP exporter: %w", err)
+		}
+		exporter = otlpExporter
+	case TracingExporterStdout:
+		stdoutExporter, err := stdout.NewExporter(stdout.WithoutMetricExport())
+		if err != nil {
+			return nil, fmt.Errorf("failed to start the stdout exporter: %w", err)
+		}
+		exporter = stdoutExporter
+	}
+	ratio := config.SampleRatio
+	if ratio == 0 {
+		ratio = 1
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.ServiceNameKey.String(tracingServiceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	return provider.Shutdown, nil
+}
+
+// tracingErrorHandler logs errors of exporting traces.
+type tracingErrorHandler struct{}
+
+func (tracingErrorHandler) Handle(err error) {
+	if err == nil {
+		return
+	}
+	log.WithError(err).Warning("Error in tracing")
+}
+
+// endSpan records err if not nil, and ends span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceHandler starts spans for requests to handler continuing incoming trace contexts.
+// Spans are renamed to route templates in instrumentRouter.
+func traceHandler(handler http.Handler) http.Handler {
+	return otelhttp.NewHandler(handler, tracingServiceName)
+}
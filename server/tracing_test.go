@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// testTracerProvider is installed in every test recording spans,
+// as tracers obtained before the first provider is installed keep delegating to it.
+var testTracerProvider = sdktrace.NewTracerProvider()
+
+// recordSpans installs testTracerProvider and the propagator of W3C Trace Context
+// until the test finishes, and returns the exporter of spans in the test.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	processor := sdktrace.NewSimpleSpanProcessor(exporter)
+	previousProvider := otel.GetTracerProvider()
+	previousPropagator := otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		testTracerProvider.UnregisterSpanProcessor(processor)
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+	testTracerProvider.RegisterSpanProcessor(processor)
+	otel.SetTracerProvider(testTracerProvider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return exporter
+}
+
+func TestTokenSpansAreInRequestTraces(t *testing.T) {
+	exporter := recordSpans(t)
+
+	config := &Config{}
+	config.Fake.Enabled = true
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("failed to create the server: %v", err)
+	}
+	ts := httptest.NewServer(traceHandler(s.router))
+	defer ts.Close()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	for _, tt := range []struct {
+		path string
+		span string
+	}{
+		{"/instance/service-accounts/default/token", "token"},
+		{"/instance/service-accounts/default/identity?audience=https://example.com", "identity-token"},
+	} {
+		t.Run(tt.span, func(t *testing.T) {
+			exporter.Reset()
+			req, err := http.NewRequest(http.MethodGet, ts.URL+metadataRoot+tt.path, nil)
+			if err != nil {
+				t.Fatalf("failed to build the request: %v", err)
+			}
+			req.Header.Set("Metadata-Flavor", "Google")
+			req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+			rsp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed to request: %v", err)
+			}
+			rsp.Body.Close()
+			if rsp.StatusCode != http.StatusOK {
+				t.Fatalf("expected %v but got %v", http.StatusOK, rsp.StatusCode)
+			}
+
+			found := false
+			for _, span := range exporter.GetSpans() {
+				if span.Name != tt.span {
+					continue
+				}
+				found = true
+				if span.SpanContext.TraceID().String() != traceID {
+					t.Errorf("%v is not in the trace of the request: %v", tt.span, span.SpanContext.TraceID())
+				}
+			}
+			if !found {
+				t.Errorf("%v is not traced", tt.span)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/ikedam/gtokenserver/log"
+)
+
+// requestValue returns a metadataValue resolving the value for the request.
+func requestValue(r *http.Request, value func(r *http.Request) (string, error)) metadataValue {
+	return func() (interface{}, error) {
+		return value(r)
+	}
+}
+
+// buildMetadataTree builds the metadata tree for the request.
+// Values are resolved only when they're accessed.
+// Changes made with the admin API are applied.
+func (s *Server) buildMetadataTree(r *http.Request) *metadataDirectory {
+	return s.overrides.apply(newMetadataDirectory(
+		metadataEntryOf("instance", s.buildInstanceTree(r)),
+		metadataEntryOf("project", s.buildProjectTree(r)),
+	))
+}
+
+func (s *Server) buildProjectTree(r *http.Request) *metadataDirectory {
+	return newMetadataDirectory(
+		metadataEntryOf("attributes", s.config.ProjectAttributes.directory()),
+		metadataEntryOf("numeric-project-id", metadataValue(func() (interface{}, error) {
+			if s.config.ProjectNumber != 0 {
+				return s.config.ProjectNumber, nil
+			}
+			cred := s.getCredentials(r.Context())
+			if cred == nil {
+				return int64(0), nil
+			}
+			return cred.GetNumericProjectID(r.Context())
+		})),
+		metadataEntryOf("project-id", metadataValue(func() (interface{}, error) {
+			cred := s.getCredentials(r.Context())
+			if cred == nil {
+				return "", nil
+			}
+			return cred.ProjectID, nil
+		})),
+	)
+}
+
+func (s *Server) buildInstanceTree(r *http.Request) *metadataDirectory {
+	networkInterface := newMetadataDirectory(
+		metadataEntryOf("ip", requestValue(r, s.instanceIP)),
+		metadataEntryOf("network", requestValue(r, s.instanceNetwork)),
+	)
+	networkInterfaces := newMetadataDirectory(
+		metadataEntryOf("0", networkInterface),
+	)
+	networkInterfaces.list = true
+	return newMetadataDirectory(
+		metadataEntryOf("attributes", s.config.Instance.Attributes.directory()),
+		metadataEntryOf("hostname", requestValue(r, s.instanceHostname)),
+		metadataEntryOf("id", metadataValue(func() (interface{}, error) {
+			return s.instanceID(r)
+		})),
+		metadataEntryOf("machine-type", requestValue(r, s.instanceMachineType)),
+		metadataEntryOf("maintenance-event", constantValue("NONE")),
+		metadataEntryOf("name", requestValue(r, s.instanceName)),
+		metadataEntryOf("network-interfaces", networkInterfaces),
+		metadataEntryOf("preempted", constantValue("FALSE")),
+		metadataEntryOf("service-accounts", s.serviceAccountsDirectory(r)),
+		metadataEntryOf("zone", requestValue(r, s.instanceZone)),
+	)
+}
+
+func (s *Server) serviceAccountsDirectory(r *http.Request) metadataLazyDirectory {
+	return func() (*metadataDirectory, error) {
+		profile := s.getClientProfileFromContext(r.Context())
+		dir := &metadataDirectory{
+			custom: true,
+		}
+		if cred := profile.defaultAccount.getCredentials(r.Context()); cred != nil {
+			dir.entries = append(
+				dir.entries,
+				metadataEntryOf("default", s.serviceAccountDirectory(r, profile, profile.defaultAccount, cred)),
+			)
+		}
+		for _, account := range profile.accounts {
+			cred := account.getCredentials(r.Context())
+			if cred == nil {
+				continue
+			}
+			email, err := cred.GetEmail(r.Context())
+			if err != nil {
+				log.WithError(err).
+					WithField(log.FieldAccount, account.name()).
+					Error("Could not retrieve email of the credential")
+				continue
+			}
+			accountDir := s.serviceAccountDirectory(r, profile, account, cred)
+			dir.entries = append(dir.entries, metadataEntryOf(email, accountDir))
+			if account.config.Alias != "" {
+				dir.entries = append(dir.entries, &metadataEntry{
+					name:   account.config.Alias,
+					node:   accountDir,
+					hidden: true,
+				})
+			}
+		}
+		return dir, nil
+	}
+}
+
+func (s *Server) serviceAccountDirectory(
+	r *http.Request,
+	profile *clientProfile,
+	account *serviceAccount,
+	cred *cachedDefaultCredentials,
+) *metadataDirectory {
+	return newMetadataDirectory(
+		metadataEntryOf("aliases", constantValue(profile.aliasesOf(account))),
+		metadataEntryOf("email", metadataValue(func() (interface{}, error) {
+			return cred.GetEmail(r.Context())
+		})),
+		metadataEntryOf("identity", metadataEndpoint{}),
+		metadataEntryOf("scopes", constantValue(account.Scopes())),
+		metadataEntryOf("token", metadataEndpoint{}),
+	)
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestServiceAccountScopes(t *testing.T) {
+	defaultScopes := []string{"https://www.googleapis.com/auth/cloud-platform"}
+	configuredScopes := []string{
+		"https://www.googleapis.com/auth/userinfo.email",
+		"https://www.googleapis.com/auth/devstorage.read_only",
+	}
+	ts := newFakeTestServer(t, &Config{
+		Scopes: defaultScopes,
+		ServiceAccounts: []ServiceAccountConfig{
+			{Alias: "defaulted"},
+			{Alias: "configured", Scopes: configuredScopes},
+		},
+	})
+
+	for _, tt := range []struct {
+		account string
+		scopes  []string
+	}{
+		{"defaulted", defaultScopes},
+		{"default", defaultScopes},
+		{"configured", configuredScopes},
+	} {
+		t.Run(tt.account, func(t *testing.T) {
+			path := "/instance/service-accounts/" + tt.account + "/"
+
+			code, body := getMetadata(t, ts, path+"scopes")
+			if code != http.StatusOK {
+				t.Fatalf("expected %v but got %v: %v", http.StatusOK, code, body)
+			}
+			if expected := strings.Join(tt.scopes, "\n") + "\n"; body != expected {
+				t.Errorf("expected %q but got %q", expected, body)
+			}
+
+			code, body = getMetadata(t, ts, path+"scopes?alt=json")
+			if code != http.StatusOK {
+				t.Fatalf("expected %v but got %v: %v", http.StatusOK, code, body)
+			}
+			var scopes []string
+			if err := json.Unmarshal([]byte(body), &scopes); err != nil {
+				t.Fatalf("failed to parse %q: %v", body, err)
+			}
+			if !reflect.DeepEqual(scopes, tt.scopes) {
+				t.Errorf("expected %v but got %v", tt.scopes, scopes)
+			}
+
+			code, body = getMetadata(t, ts, path)
+			if code != http.StatusOK {
+				t.Fatalf("expected %v but got %v: %v", http.StatusOK, code, body)
+			}
+			if !strings.Contains(body, "\nscopes\n") {
+				t.Errorf("scopes is not listed in %q", body)
+			}
+
+			code, body = getMetadata(t, ts, path+"?recursive=true")
+			if code != http.StatusOK {
+				t.Fatalf("expected %v but got %v: %v", http.StatusOK, code, body)
+			}
+			var recursive struct {
+				Scopes []string `json:"scopes"`
+			}
+			if err := json.Unmarshal([]byte(body), &recursive); err != nil {
+				t.Fatalf("failed to parse %q: %v", body, err)
+			}
+			if !reflect.DeepEqual(recursive.Scopes, tt.scopes) {
+				t.Errorf("expected %v but got %v", tt.scopes, recursive.Scopes)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// metadataPollInterval is the interval to re-evaluate values for wait_for_change.
+// Values can be changed without notifications (e.g. attributes from files).
+const metadataPollInterval = time.Second
+
+var errMetadataNotFound = errors.New("metadata not found")
+
+// computeETag computes the ETag of the response body.
+func computeETag(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	// The actual metadata server uses 16 hex digits.
+	return hex.EncodeToString(sum[:8])
+}
+
+// changeNotifier notifies goroutines waiting for changes of the metadata
+type changeNotifier struct {
+	mutex   sync.Mutex
+	changed chan struct{}
+}
+
+func newChangeNotifier() *changeNotifier {
+	return &changeNotifier{
+		changed: make(chan struct{}),
+	}
+}
+
+// wait returns the channel closed at the next change.
+func (n *changeNotifier) wait() <-chan struct{} {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.changed
+}
+
+// notify wakes up all goroutines waiting for changes.
+func (n *changeNotifier) notify() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+// waitForChangeRequest is parameters of wait_for_change requests
+type waitForChangeRequest struct {
+	lastETag string
+	// timeout is 0 for no timeout.
+	timeout time.Duration
+}
+
+// parseWaitForChange parses wait_for_change parameters.
+// It returns nil if wait_for_change is not requested.
+func parseWaitForChange(query url.Values) (*waitForChangeRequest, error) {
+	if query.Get("wait_for_change") != "true" {
+		return nil, nil
+	}
+	wait := &waitForChangeRequest{
+		lastETag: query.Get("last_etag"),
+	}
+	if timeoutSec := query.Get("timeout_sec"); timeoutSec != "" {
+		sec, err := strconv.Atoi(timeoutSec)
+		if err != nil || sec < 0 {
+			return nil, fmt.Errorf("invalid timeout_sec: %v", timeoutSec)
+		}
+		wait.timeout = time.Duration(sec) * time.Second
+	}
+	return wait, nil
+}
+
+// waitForChange blocks until the value at the path differs from last_etag,
+// or from the current value if last_etag is not specified.
+// It returns the current value when the timeout expires.
+func (s *Server) waitForChange(
+	r *http.Request,
+	wait *waitForChangeRequest,
+	path string,
+	recursive bool,
+	alt string,
+	body string,
+	contentType string,
+) (string, string, error) {
+	lastETag := wait.lastETag
+	if lastETag == "" {
+		lastETag = computeETag(body)
+	}
+	if computeETag(body) != lastETag {
+		return body, contentType, nil
+	}
+
+	var timeout <-chan time.Time
+	if wait.timeout > 0 {
+		timer := time.NewTimer(wait.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	ticker := time.NewTicker(metadataPollInterval)
+	defer ticker.Stop()
+
+	for {
+		changed := s.metadataChanged.wait()
+		select {
+		case <-changed:
+		case <-ticker.C:
+		case <-timeout:
+			return body, contentType, nil
+		case <-s.running.shuttingDown:
+			// Not to block shutdown.
+			return body, contentType, nil
+		case <-r.Context().Done():
+			return "", "", r.Context().Err()
+		}
+
+		// Evaluate with the current configuration as it may be reloaded.
+		current := s.running.get()
+		currentRequest := r
+		if current != s {
+			var err error
+			currentRequest, err = current.withClientProfile(r)
+			if err != nil {
+				return "", "", err
+			}
+		}
+		node, _, err := lookupMetadata(current.buildMetadataTree(currentRequest), path)
+		if err != nil {
+			return "", "", err
+		}
+		if node == nil {
+			return "", "", errMetadataNotFound
+		}
+		body, contentType, err = renderMetadata(node, recursive, alt)
+		if err != nil {
+			return "", "", err
+		}
+		if computeETag(body) != lastETag {
+			return body, contentType, nil
+		}
+	}
+}